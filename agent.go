@@ -2,25 +2,90 @@
 package zagent
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 var (
+	// Deprecated: DataLength is now read as a fixed size integer so these
+	// are no longer returned.
 	DataLengthBufferTooSmall = errors.New("DataLength buffer too small")
 	DataLengthOverflow       = errors.New("DataLength is too large")
 
+	// The agent closed the connection without sending anything. This
+	// usually means our address isn't in the agent's Server= list.
+	ErrEmptyResponse = errors.New("agent closed the connection without responding")
+
+	// The response didn't start with ZBXD so it isn't from a zabbix agent.
+	ErrInvalidHeader = errors.New("response header is not ZBXD")
+
+	// The connection was closed before the whole response was received.
+	ErrTruncatedResponse = errors.New("response truncated")
+
+	// The response arrived slower than Agent.MinReadRate.
+	ErrTooSlow = errors.New("response read rate below minimum")
+
+	// The agent reset the connection part way through the response,
+	// e.g. because it crashed.
+	ErrConnectionReset = errors.New("connection reset while reading response")
+
+	// Nothing arrived for Agent.IdleTimeout while reading the response.
+	ErrIdleTimeout = errors.New("response idle timeout")
+
+	// The agent sent more data after its response while
+	// Agent.ExpectConnectionClose was set.
+	ErrTrailingData = errors.New("data after response")
+
+	// The agent closed the connection without responding and answers TLS
+	// handshakes, so its TLSAccept doesn't allow unencrypted connections.
+	// It always wraps ErrEmptyResponse too.
+	ErrTLSRequired = errors.New("agent requires TLS, check its TLSAccept setting")
+
+	// The key doesn't match any of Agent.AllowedKeys.
+	ErrKeyNotAllowed = errors.New("key not allowed")
+
+	// The agent answered agent.ping with something other than 1, e.g.
+	// in PingReport and Registry.ValidateAll.
+	ErrPingFailed = errors.New("agent.ping didn't return 1")
+
 	// This is the default timeout when contacting a Zabbix Agent.
 	DefaultTimeout = time.Duration(30 * time.Second)
+
+	// The default Agent.MaxDataLength, the same limit zabbix itself uses.
+	DefaultMaxDataLength uint64 = 1 << 30
+
+	// The agent's response is larger than Agent.MaxDataLength. It's the
+	// same error as ErrFrameTooLarge.
+	ErrResponseTooLarge = ErrFrameTooLarge
 )
 
 const (
 	NotSupported = "ZBX_NOTSUPPORTED"
+
+	// The port zabbix agents listen on by default.
+	DefaultPort = 10050
 )
 
+// NotSupportedError is returned when the agent replies with ZBX_NOTSUPPORTED.
+type NotSupportedError struct {
+	Key    string
+	Reason string // The reason given by the agent, if any
+}
+
+func (e *NotSupportedError) Error() string {
+	return e.Key + " is not supported"
+}
+
 // Filesystem respresents a Zabbix filesystem as presented by vfs.fs.discovery
 type Filesystem struct {
 	Name string
@@ -42,11 +107,196 @@ type CPU struct {
 type Agent struct {
 	Host string
 	Port int
+
+	// If set the agent is dialed at IP instead of resolving Host, e.g.
+	// when the poller has already resolved it. Host still names the agent.
+	IP net.IP `json:",omitempty"`
+
+	// Arbitrary labels, e.g. site or role, used to select agents from an AgentSet.
+	Labels map[string]string `json:",omitempty"`
+
+	// Timeout used when a query doesn't specify one. If < 1 DefaultTimeout
+	// is used.
+	Timeout time.Duration
+
+	// If ExpectedHostname is set, agent.hostname is compared against it
+	// (case insensitively) before the first query and queries fail with a
+	// *HostnameMismatchError while it differs. This catches DNS or load
+	// balancer mistakes sending us to the wrong machine.
+	ExpectedHostname string
+
+	// NormalizeHostname, if set, is applied to both hostnames before
+	// comparing them, e.g. to strip a domain.
+	NormalizeHostname func(string) string `json:"-"`
+
+	// How long a hostname check result is trusted. If < 1 a successful
+	// check is trusted forever and a failed one is retried on every query.
+	HostnameCheckInterval time.Duration
+
+	// Responses declaring more data than this are rejected with
+	// ErrResponseTooLarge before any of it is read. If < 1
+	// DefaultMaxDataLength is used.
+	MaxDataLength uint64
+
+	// If MinReadRate (bytes per second) is set, responses arriving slower
+	// than it over MinReadRateWindow (a second by default) are aborted with
+	// ErrTooSlow. This protects against agents trickling data to stay
+	// within the timeout. Measuring starts at the first byte received.
+	MinReadRate       float64
+	MinReadRateWindow time.Duration
+
+	// If IdleTimeout is set, reading a response fails with ErrIdleTimeout
+	// when nothing arrives for that long, including while waiting for the
+	// first byte. Unlike the overall timeout it's reset by every read, for
+	// large responses over slow links. The overall timeout still applies.
+	IdleTimeout time.Duration
+
+	// ResponseHook, if set, is called with every parsed response before
+	// it's returned. It may modify the response and a non-nil error is
+	// returned to the caller instead of the response.
+	ResponseHook func(*Response) error `json:"-"`
+
+	// Responses are read by their declared length so agents that keep the
+	// connection open don't make queries wait for the timeout. If
+	// ExpectConnectionClose is set the agent must also close the connection
+	// after responding, anything else it sends fails with ErrTrailingData.
+	ExpectConnectionClose bool
+
+	// How keys are sent to the agent, see FramingMode. Defaults to FramingPlain.
+	Framing FramingMode
+
+	// AllowRemoteCommands must be set before Run will execute commands
+	// with system.run, so remote execution is never used by accident.
+	AllowRemoteCommands bool
+
+	// If not empty only keys matching one of these patterns can be
+	// queried, where * matches any sequence of characters, e.g. agent.*
+	// or system.cpu.util[*]. Other keys fail with ErrKeyNotAllowed
+	// without connecting.
+	AllowedKeys []string
+
+	// Decides the kind of value GetTyped2 parses a response as, instead of
+	// the default ClassifyValue.
+	ValueClassifier func([]byte) ValueKind `json:"-"`
+
+	// Decides whether a response means the key isn't supported, for
+	// agents or proxies that don't reply ZBX_NOTSUPPORTED. It's used by
+	// Response.Supported and everything that checks it. Nil means the
+	// data must start with ZBX_NOTSUPPORTED.
+	UnsupportedFunc func([]byte) bool `json:"-"`
+
+	// Cache the results of discovery keys used by the Discover* methods
+	// and InterfaceTraffic. Nil means discovery is queried every time.
+	DiscoveryCache *DiscoveryCache `json:"-"`
+
+	// Share a ByteBudget between agents to limit the total size of the
+	// responses they read at once. Nil means no limit.
+	ByteBudget *ByteBudget `json:"-"`
+
+	mu           sync.Mutex
+	hostnameErr  error     // Result of the last hostname check
+	hostnameTime time.Time // When the hostname was last checked, zero if never
+	variant      Variant   // Cached by Variant once known
+	framingMode  FramingMode
+	framingKnown bool // framingMode has been chosen for FramingAuto
+
+	hostnameCheck sync.Mutex // Held while checking the hostname, not just reading the result
+
+	tlsMu       sync.Mutex // Guards tlsRequired and tlsKnown, separate from mu for the query path
+	tlsRequired bool       // The agent answered a TLS handshake after closing a plaintext connection
+	tlsKnown    bool       // tlsRequired has been checked
 }
 
-// Creates a new Agent with a default port of 10050
+// Creates a new Agent with a default port of DefaultPort
 func NewAgent(host string) *Agent {
-	return &Agent{Host: host, Port: 10050}
+	return &Agent{Host: host, Port: DefaultPort}
+}
+
+/*
+	Creates a new Agent from an address such as web01:10050, 192.0.2.1 or
+	[fe80::1%eth0]:10050. The port defaults to DefaultPort.
+*/
+func NewAgentFromAddr(addr string) (*Agent, error) {
+	host, portS, err := net.SplitHostPort(addr)
+	if err != nil {
+		// Allow a host without a port, e.g. web01 or [fe80::1%eth0]
+		host, portS = addr, strconv.Itoa(DefaultPort)
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+		if _, ipErr := netip.ParseAddr(host); ipErr != nil && strings.ContainsAny(host, ":[]") {
+			return nil, err
+		}
+	}
+
+	port, err := strconv.Atoi(portS)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid port: %w", addr, err)
+	}
+
+	if host == "" {
+		return nil, fmt.Errorf("%s: missing host", addr)
+	}
+	if strings.Contains(host, "%") {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return nil, fmt.Errorf("%s: invalid scoped address: %w", addr, err)
+		}
+	}
+
+	return &Agent{Host: host, Port: port}, nil
+}
+
+// Returns a copy of the agent's configuration without any cached state.
+func (a *Agent) clone() *Agent {
+	return &Agent{
+		Host:                  a.Host,
+		Port:                  a.Port,
+		IP:                    a.IP,
+		Labels:                a.Labels,
+		Timeout:               a.Timeout,
+		ExpectedHostname:      a.ExpectedHostname,
+		NormalizeHostname:     a.NormalizeHostname,
+		HostnameCheckInterval: a.HostnameCheckInterval,
+		MaxDataLength:         a.MaxDataLength,
+		MinReadRate:           a.MinReadRate,
+		MinReadRateWindow:     a.MinReadRateWindow,
+		IdleTimeout:           a.IdleTimeout,
+		ResponseHook:          a.ResponseHook,
+		ExpectConnectionClose: a.ExpectConnectionClose,
+		Framing:               a.Framing,
+		AllowRemoteCommands:   a.AllowRemoteCommands,
+		AllowedKeys:           a.AllowedKeys,
+		ValueClassifier:       a.ValueClassifier,
+		UnsupportedFunc:       a.UnsupportedFunc,
+		DiscoveryCache:        a.DiscoveryCache,
+		ByteBudget:            a.ByteBudget,
+	}
+}
+
+// Returns an error wrapping ErrKeyNotAllowed if AllowedKeys is set and key doesn't match it.
+func (a *Agent) checkKeyAllowed(key string) error {
+	if len(a.AllowedKeys) == 0 {
+		return nil
+	}
+
+	for _, pattern := range a.AllowedKeys {
+		if matchKey(pattern, key) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: %w", key, ErrKeyNotAllowed)
+}
+
+// Returns timeout, or Agent.Timeout or DefaultTimeout if it's < 1.
+func (a *Agent) timeout(timeout time.Duration) time.Duration {
+	if timeout < 1 {
+		timeout = a.Timeout
+	}
+	if timeout < 1 {
+		timeout = DefaultTimeout
+	}
+	return timeout
 }
 
 // Returns a string with the host and port concatenated to host:port
@@ -55,27 +305,332 @@ func (a *Agent) hostPort() string {
 	return net.JoinHostPort(a.Host, portS)
 }
 
+// Returns the agent's address as host:port, e.g. [fe80::1%eth0]:10050.
+func (a *Agent) String() string {
+	return a.hostPort()
+}
+
+/*
+	Dial the agent. The zone of link-local IPv6 addresses is checked first
+	since dialing a missing interface gives an unhelpful error. For "tcp"
+	net.Dialer already races the address families of dual-stack hosts
+	(Happy Eyeballs), starting the other family if the first hasn't
+	connected within 300ms.
+*/
+func (a *Agent) dial(ctx context.Context, network string) (net.Conn, error) {
+	if err := checkZone(a.Host); err != nil {
+		return nil, err
+	}
+
+	addr := a.hostPort()
+	if a.IP != nil {
+		addr = net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// Returns an error if host is an IPv6 address whose zone isn't an interface.
+func checkZone(host string) error {
+	addr, err := netip.ParseAddr(host)
+	if err != nil || addr.Zone() == "" {
+		return nil
+	}
+
+	zone := addr.Zone()
+	if index, err := strconv.Atoi(zone); err == nil {
+		_, err = net.InterfaceByIndex(index)
+		if err != nil {
+			return fmt.Errorf("%s: zone %s is not a valid interface index: %w", host, zone, err)
+		}
+		return nil
+	}
+
+	if _, err := net.InterfaceByName(zone); err != nil {
+		return fmt.Errorf("%s: zone %s is not a network interface on this host: %w", host, zone, err)
+	}
+	return nil
+}
+
 /*
 	Run the check (key) against the Zabbix agent with the specified timeout.
-	If timeout is < 1 DefaultTimeout will be used.
+	If timeout is < 1 Agent.Timeout or DefaultTimeout will be used.
 */
 func (a *Agent) Query(key string, timeout time.Duration) (*Response, error) {
-	if timeout < 1 {
-		timeout = DefaultTimeout
+	return a.query("tcp", key, timeout)
+}
+
+// Run the check (key) over the given network ("tcp", "tcp4" or "tcp6").
+func (a *Agent) query(network, key string, timeout time.Duration) (*Response, error) {
+	if err := a.checkKeyAllowed(key); err != nil {
+		return nil, err
+	}
+
+	err := a.verifyHostname(func() (*Response, error) {
+		return a.roundTrip(network, "agent.hostname", timeout)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a.roundTrip(network, key, timeout)
+}
+
+// Dial the agent and run a single check without verifying the hostname.
+func (a *Agent) roundTrip(network, key string, timeout time.Duration) (*Response, error) {
+	timeout = a.timeout(timeout)
+	deadline := time.Now().Add(timeout)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// Before dialing, agents serving one connection at a time would never
+	// answer a probe while our connection is open
+	mode, err := a.framing(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	conn, err := net.DialTimeout("tcp", a.hostPort(), timeout)
+	start := time.Now()
+	conn, err := a.dial(ctx, network)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
+	dialTime := time.Since(start)
+
+	conn.SetDeadline(deadline)
+
+	res, err := a.exchange(ctx, conn, key, mode, dialTime)
+	return res, a.tlsRequiredError(ctx, err)
+}
 
-	_, err = fmt.Fprintf(conn, key)
+/*
+	Run the check (key) against the Zabbix agent. The context's deadline
+	applies to the whole exchange and cancelling the context aborts it. If
+	the context has no deadline Agent.Timeout or DefaultTimeout is used.
+*/
+func (a *Agent) QueryContext(ctx context.Context, key string) (*Response, error) {
+	if err := a.checkKeyAllowed(key); err != nil {
+		return nil, err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout(0))
+		defer cancel()
+	}
+
+	err := a.verifyHostname(func() (*Response, error) {
+		return a.roundTripContext(ctx, "agent.hostname")
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return ParseResponse(conn)
+	return a.roundTripContext(ctx, key)
+}
+
+// Like roundTrip but bound to the context instead of a timeout.
+func (a *Agent) roundTripContext(ctx context.Context, key string) (*Response, error) {
+	mode, err := a.framing(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	conn, err := a.dial(ctx, "tcp")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	dialTime := time.Since(start)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Unblock any pending read or write as soon as the context is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	res, err := a.exchange(ctx, conn, key, mode, dialTime)
+	if err != nil && ctx.Err() != nil {
+		return res, ctx.Err()
+	}
+
+	return res, a.tlsRequiredError(ctx, err)
+}
+
+/*
+	If err is ErrEmptyResponse check whether the agent speaks TLS and if
+	so return an error wrapping ErrTLSRequired as well, since agents
+	requiring TLS close plaintext connections the same way as agents
+	whose Server= list excludes us. The check dials again so its result
+	is cached on the agent.
+*/
+func (a *Agent) tlsRequiredError(ctx context.Context, err error) error {
+	if err != ErrEmptyResponse {
+		return err
+	}
+
+	a.tlsMu.Lock()
+	required, known := a.tlsRequired, a.tlsKnown
+	a.tlsMu.Unlock()
+
+	if !known {
+		required = probeTLS(ctx, a, a.timeout(0))
+		if ctx.Err() != nil {
+			return err
+		}
+
+		a.tlsMu.Lock()
+		a.tlsRequired, a.tlsKnown = required, true
+		a.tlsMu.Unlock()
+	}
+
+	if required {
+		return fmt.Errorf("%w: %w", ErrTLSRequired, ErrEmptyResponse)
+	}
+	return err
+}
+
+/*
+	Run the checks (keys) one after another, stopping at the first error.
+	Once the context is done no further keys are sent and the responses
+	collected so far are returned along with the context's error.
+*/
+func (a *Agent) GetManyContext(ctx context.Context, keys []string) ([]*Response, error) {
+	responses := make([]*Response, 0, len(keys))
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return responses, err
+		}
+
+		res, err := a.QueryContext(ctx, key)
+		if err != nil {
+			return responses, err
+		}
+
+		responses = append(responses, res)
+	}
+
+	return responses, nil
+}
+
+// KeySpec is a key to query with its own timeout, < 1 for the default.
+type KeySpec struct {
+	Key     string
+	Timeout time.Duration
+}
+
+/*
+	Run the checks one after another, each with its own timeout, stopping
+	at the first error. The responses collected so far are returned along
+	with the error.
+*/
+func (a *Agent) GetManyTimed(specs []KeySpec) ([]*Response, error) {
+	responses := make([]*Response, 0, len(specs))
+
+	for _, spec := range specs {
+		res, err := a.Query(spec.Key, spec.Timeout)
+		if err != nil {
+			return responses, err
+		}
+
+		responses = append(responses, res)
+	}
+
+	return responses, nil
+}
+
+/*
+	Send the key over an established connection and parse the response.
+	dialTime is how long establishing the connection took, for the
+	response's Timings.
+*/
+func (a *Agent) exchange(ctx context.Context, conn net.Conn, key string, mode FramingMode, dialTime time.Duration) (*Response, error) {
+	start := time.Now()
+	if err := writeRequest(conn, key, mode); err != nil {
+		return nil, err
+	}
+	written := time.Now()
+
+	maxDataLength := a.MaxDataLength
+	if maxDataLength < 1 {
+		maxDataLength = DefaultMaxDataLength
+	}
+
+	var cr io.Reader = conn
+	if a.IdleTimeout > 0 {
+		cr = &idleReader{ctx: ctx, conn: conn, idle: a.IdleTimeout}
+	}
+
+	fr := &firstByteReader{r: cr}
+	var r io.Reader = fr
+	if a.MinReadRate > 0 {
+		r = &rateReader{r: fr, rate: a.MinReadRate, window: a.MinReadRateWindow}
+	}
+
+	var reserve func(uint64) error
+	if a.ByteBudget != nil {
+		var held uint64
+		defer func() { a.ByteBudget.release(held) }()
+		reserve = func(size uint64) (err error) {
+			held, err = a.ByteBudget.acquire(ctx, size)
+			return err
+		}
+	}
+
+	res, err := parseResponse(r, maxDataLength, progressFrom(ctx), partialFrom(ctx), reserve)
+	if res != nil {
+		res.Timings = Timings{
+			Dial:            dialTime,
+			Write:           written.Sub(start),
+			TimeToFirstByte: fr.first.Sub(written),
+			Read:            res.ReceivedAt.Sub(fr.first),
+		}
+	}
+	if err != nil {
+		return res, err
+	}
+
+	if mode == FramingZBXDJSON {
+		unwrapJSONReply(res)
+	}
+	res.unsupported = a.UnsupportedFunc
+
+	if a.ExpectConnectionClose {
+		if err := expectClose(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if a.ResponseHook != nil {
+		if err := a.ResponseHook(res); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// Wait for r to end, returning ErrTrailingData if it doesn't end straight away.
+func expectClose(r io.Reader) error {
+	n, err := r.Read(make([]byte, 1))
+	switch {
+	case n > 0:
+		return ErrTrailingData
+	case err == io.EOF:
+		return nil
+	case err == nil:
+		return expectClose(r)
+	}
+	return err
 }
 
 /*
@@ -86,7 +641,10 @@ func (a *Agent) Query(key string, timeout time.Duration) (*Response, error) {
 func (a *Agent) queryJSON(key string, timeout time.Duration) (map[string][]map[string]interface{}, error) {
 	data := make(map[string][]map[string]interface{})
 
-	res, err := a.Query(key, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout(timeout))
+	defer cancel()
+
+	res, err := a.queryDiscovery(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -177,6 +735,27 @@ func (a *Agent) AgentPing(timeout time.Duration) (bool, error) {
 	return res.Bool()
 }
 
+// Liveness is the result of a single agent.ping probe.
+type Liveness struct {
+	Reachable bool          // agent.ping returned 1
+	RTT       time.Duration // Time taken by the whole query, including connecting
+	At        time.Time     // When the probe started
+}
+
+/*
+	Probe the agent with agent.ping and time it. On failure Reachable is
+	false and the error is returned along with the timing.
+*/
+func (a *Agent) Liveness(timeout time.Duration) (Liveness, error) {
+	l := Liveness{At: time.Now()}
+
+	ok, err := a.AgentPing(timeout)
+	l.RTT = time.Since(l.At)
+	l.Reachable = err == nil && ok
+
+	return l, err
+}
+
 /*
 	Calls agent.version on the zabbix agent and returns the version
 	and/or any errors associated with the action.
@@ -185,3 +764,248 @@ func (a *Agent) AgentVersion(timeout time.Duration) (string, error) {
 	res, err := a.Query("agent.version", timeout)
 	return res.String(), err
 }
+
+/*
+	Resolve the host, unless IP is set, and call agent.ping over IPv4 and
+	IPv6 separately.
+	This is useful for debugging agents that only listen on one address
+	family. An error is only returned if the host can't be resolved.
+*/
+func (a *Agent) ReachabilityByFamily(timeout time.Duration) (v4ok, v6ok bool, err error) {
+	if a.IP == nil {
+		if _, err = net.LookupHost(a.Host); err != nil {
+			return false, false, err
+		}
+	}
+
+	return a.pingNetwork("tcp4", timeout), a.pingNetwork("tcp6", timeout), nil
+}
+
+// Returns true if agent.ping succeeds over the given network.
+func (a *Agent) pingNetwork(network string, timeout time.Duration) bool {
+	res, err := a.query(network, "agent.ping", timeout)
+	if err != nil {
+		return false
+	}
+
+	ok, err := res.Bool()
+	return err == nil && ok
+}
+
+// FSSize is the capacity of a filesystem as reported by vfs.fs.size.
+type FSSize struct {
+	Total       uint64
+	Free        uint64
+	Used        uint64
+	PercentFree float64
+}
+
+/*
+	Query the total, free, used and pfree modes of vfs.fs.size for the
+	filesystem mounted at path. Passive agents close the connection after
+	each value so every mode is a separate query.
+*/
+func (a *Agent) FilesystemSize(path string, timeout time.Duration) (FSSize, error) {
+	size := FSSize{}
+
+	for _, mode := range []string{"total", "free", "used", "pfree"} {
+		key := BuildKey("vfs.fs.size", path, mode)
+
+		res, err := a.Query(key, timeout)
+		if err != nil {
+			return size, err
+		}
+
+		if err := res.notSupportedError(key); err != nil {
+			return size, err
+		}
+
+		switch mode {
+		case "total":
+			size.Total, err = strconv.ParseUint(res.String(), 10, 64)
+		case "free":
+			size.Free, err = strconv.ParseUint(res.String(), 10, 64)
+		case "used":
+			size.Used, err = strconv.ParseUint(res.String(), 10, 64)
+		case "pfree":
+			size.PercentFree, err = res.Float64()
+		}
+
+		if err != nil {
+			return size, err
+		}
+	}
+
+	return size, nil
+}
+
+/*
+	Query the key on each of ports on the agent's host concurrently, for
+	hosts running several agent instances. Responses and errors are keyed
+	by port, every port ends up in exactly one of the maps.
+*/
+func (a *Agent) GetOnPorts(key string, ports []int, timeout time.Duration) (map[int]*Response, map[int]error) {
+	responses := make(map[int]*Response)
+	errs := make(map[int]error)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, port := range ports {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+
+			agent := a.clone()
+			agent.Port = port
+			res, err := agent.Query(key, timeout)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[port] = err
+			} else {
+				responses[port] = res
+			}
+		}(port)
+	}
+	wg.Wait()
+
+	return responses, errs
+}
+
+/*
+	Query every key in expectations and compare its value to the expected
+	one. Returns nil if all match, otherwise an error joining one error per
+	mismatch (key=X got Y want Z) or failed query, in key order.
+*/
+func (a *Agent) Assert(expectations map[string]string, timeout time.Duration) error {
+	keys := make([]string, 0, len(expectations))
+	for key := range expectations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		res, err := a.Query(key, timeout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("key=%s: %w", key, err))
+			continue
+		}
+
+		if got, want := res.String(), expectations[key]; got != want {
+			errs = append(errs, fmt.Errorf("key=%s got %s want %s", key, got, want))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+/*
+	Query each key in order and return the first response that isn't
+	ZBX_NOTSUPPORTED, for values whose key changed between agent versions.
+	Network errors abort straight away. If no key is supported the last
+	response is returned with its *NotSupportedError.
+*/
+func (a *Agent) GetFirstSupported(keys []string, timeout time.Duration) (*Response, error) {
+	var res *Response
+	var err error
+	for _, key := range keys {
+		if res, err = a.Query(key, timeout); err != nil {
+			return nil, err
+		}
+
+		if err = res.notSupportedError(key); err == nil {
+			return res, nil
+		}
+	}
+
+	return res, err
+}
+
+/*
+	MetricSpec defines a metric once across agent versions: the keys that
+	have served it, newest or preferred first, and how to turn a response
+	into a value, e.g. converting units. A nil Transform uses
+	Response.Float64.
+*/
+type MetricSpec struct {
+	Keys      []string
+	Transform func(*Response) (float64, error)
+}
+
+/*
+	Query each of spec's keys in order and return the first value that is
+	supported and transforms without error. Network errors abort straight
+	away, otherwise the error for the last key is returned.
+*/
+func (a *Agent) GetNormalized(spec MetricSpec, timeout time.Duration) (float64, error) {
+	if len(spec.Keys) == 0 {
+		return 0, errors.New("metric spec has no keys")
+	}
+
+	transform := spec.Transform
+	if transform == nil {
+		transform = (*Response).Float64
+	}
+
+	var err error
+	for _, key := range spec.Keys {
+		var res *Response
+		if res, err = a.Query(key, timeout); err != nil {
+			return 0, err
+		}
+
+		if err = res.notSupportedError(key); err != nil {
+			continue
+		}
+
+		var v float64
+		if v, err = transform(res); err == nil {
+			return v, nil
+		}
+		err = fmt.Errorf("%s: %w", key, err)
+	}
+
+	return 0, err
+}
+
+/*
+	Query the key and return only Response.Data. A ZBX_NOTSUPPORTED reply
+	is returned as a *NotSupportedError instead.
+*/
+func (a *Agent) GetBytes(key string, timeout time.Duration) ([]byte, error) {
+	res, err := a.Query(key, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := res.notSupportedError(key); err != nil {
+		return nil, err
+	}
+
+	return res.Data, nil
+}
+
+/*
+	Query the key and parse its data with parse, e.g. a strconv wrapper or
+	a JSON decoder. A ZBX_NOTSUPPORTED reply is returned as a
+	*NotSupportedError without calling parse, parse errors are returned
+	prefixed with the key. See Agent.GetTyped for decoding JSON into an
+	existing value.
+*/
+func GetTyped[T any](a *Agent, key string, parse func([]byte) (T, error), timeout time.Duration) (T, error) {
+	var zero T
+
+	data, err := a.GetBytes(key, timeout)
+	if err != nil {
+		return zero, err
+	}
+
+	v, err := parse(data)
+	if err != nil {
+		return zero, fmt.Errorf("%s: %w", key, err)
+	}
+
+	return v, nil
+}
@@ -1,10 +1,19 @@
 package zagent
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // You must set and export the shell variable ZABBIX_HOST in
@@ -149,3 +158,587 @@ func TestQueryInterface(t *testing.T) {
 		fmt.Println("system.cpu.num was converted to int64")
 	}
 }
+
+func TestReachabilityByFamily(t *testing.T) {
+	fake := newFakeAgent(t, "tcp4", "127.0.0.1:0", map[string]string{"agent.ping": "1"})
+
+	agent := fake.agent()
+	agent.Host = "localhost"
+
+	v4ok, v6ok, err := agent.ReachabilityByFamily(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !v4ok {
+		t.Fatal("Agent should be reachable over IPv4")
+	}
+
+	if v6ok {
+		t.Fatal("Agent shouldn't be reachable over IPv6")
+	}
+}
+
+func TestResponseHook(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"agent.hostname": "web01",
+		"system.run[id]": "uid=0(root)",
+	})
+
+	agent := fake.agent()
+	agent.ResponseHook = func(r *Response) error {
+		r.Data = bytes.ToUpper(r.Data)
+		return nil
+	}
+
+	res, err := agent.Query("agent.hostname", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.String() != "WEB01" {
+		t.Fatal("Hook wasn't applied, got:", res.String())
+	}
+
+	errRejected := errors.New("value rejected")
+	agent.ResponseHook = func(r *Response) error {
+		if bytes.HasPrefix(r.Data, []byte("uid=")) {
+			return errRejected
+		}
+		return nil
+	}
+
+	res, err = agent.Query("system.run[id]", time.Second)
+	if err != errRejected {
+		t.Fatal("Expected the hook's error, got:", err)
+	}
+
+	if res != nil {
+		t.Fatal("Response should be nil when the hook rejects it")
+	}
+}
+
+func TestFilesystemSize(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		`vfs.fs.size["/mnt/a,b",total]`: "1000",
+		`vfs.fs.size["/mnt/a,b",free]`:  "250",
+		`vfs.fs.size["/mnt/a,b",used]`:  "750",
+		`vfs.fs.size["/mnt/a,b",pfree]`: "25.000000",
+	})
+
+	size, err := fake.agent().FilesystemSize("/mnt/a,b", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := FSSize{Total: 1000, Free: 250, Used: 750, PercentFree: 25}
+	if size != want {
+		t.Fatalf("Expected %+v, got %+v", want, size)
+	}
+
+	_, err = fake.agent().FilesystemSize("/missing", time.Second)
+	if _, ok := err.(*NotSupportedError); !ok {
+		t.Fatal("Expected a NotSupportedError, got:", err)
+	}
+}
+
+func TestGetManyContext(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"agent.ping":     "1",
+		"agent.version":  "6.0.21",
+		"agent.hostname": "web01",
+	})
+
+	agent := fake.agent()
+	keys := []string{"agent.ping", "agent.version", "agent.hostname"}
+
+	responses, err := agent.GetManyContext(context.Background(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(responses) != 3 || responses[1].String() != "6.0.21" {
+		t.Fatal("Unexpected responses:", responses)
+	}
+
+	// Cancel as soon as the first key completes
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	agent.ResponseHook = func(*Response) error {
+		cancel()
+		return nil
+	}
+
+	fake = newFakeAgent(t, "tcp", "127.0.0.1:0", fake.items)
+	agent.Port = fake.agent().Port
+
+	responses, err = agent.GetManyContext(ctx, keys)
+	if err != context.Canceled {
+		t.Fatal("Expected context.Canceled, got:", err)
+	}
+
+	if len(responses) != 1 || responses[0].String() != "1" {
+		t.Fatal("Expected only the first response, got:", responses)
+	}
+
+	if received := fake.received(); len(received) != 1 {
+		t.Fatal("Later keys shouldn't have been sent, got:", received)
+	}
+}
+
+func TestGetManyTimed(t *testing.T) {
+	agent := newFakeAgentFunc(t, "tcp", "127.0.0.1:0", func(key string) string {
+		if key == "system.run[sleep 0.2]" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return "1"
+	}).agent()
+
+	specs := []KeySpec{
+		{"agent.ping", 100 * time.Millisecond},
+		{"system.run[sleep 0.2]", time.Second},
+	}
+
+	responses, err := agent.GetManyTimed(specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 2 {
+		t.Fatal("Unexpected responses:", responses)
+	}
+
+	// The slow key fails with the fast key's timeout and stops the batch
+	specs = []KeySpec{
+		{"system.run[sleep 0.2]", 100 * time.Millisecond},
+		{"agent.ping", time.Second},
+	}
+	start := time.Now()
+	responses, err = agent.GetManyTimed(specs)
+	if err == nil || len(responses) != 0 {
+		t.Fatal("Expected a timeout, got:", responses, err)
+	}
+	if elapsed := time.Since(start); elapsed > 180*time.Millisecond {
+		t.Fatal("The short timeout wasn't applied, took", elapsed)
+	}
+}
+
+func TestGetOnPorts(t *testing.T) {
+	first := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.hostname": "instance1"}).agent()
+	second := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.hostname": "instance2"}).agent()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := agentFor(closed).Port
+	closed.Close()
+
+	responses, errs := first.GetOnPorts("agent.hostname", []int{first.Port, second.Port, closedPort}, time.Second)
+
+	if len(responses) != 2 || responses[first.Port].String() != "instance1" || responses[second.Port].String() != "instance2" {
+		t.Fatal("Unexpected responses:", responses)
+	}
+
+	if len(errs) != 1 || errs[closedPort] == nil {
+		t.Fatal("Expected an error for the closed port, got:", errs)
+	}
+}
+
+func TestAssert(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"agent.ping":      "1",
+		"agent.version":   "5.0.1",
+		"system.hostname": "web01",
+	}).agent()
+
+	err := agent.Assert(map[string]string{"agent.ping": "1", "system.hostname": "web01"}, time.Second)
+	if err != nil {
+		t.Fatal("Expected all expectations to match, got:", err)
+	}
+
+	err = agent.Assert(map[string]string{
+		"agent.ping":      "1",
+		"agent.version":   "6.0.21",
+		"system.hostname": "web02",
+	}, time.Second)
+
+	want := "key=agent.version got 5.0.1 want 6.0.21\nkey=system.hostname got web01 want web02"
+	if err == nil || err.Error() != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%v", want, err)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "1"}).agent()
+
+	l, err := agent.Liveness(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Reachable || l.RTT <= 0 || time.Since(l.At) > time.Second {
+		t.Fatalf("Unexpected liveness: %+v", l)
+	}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent = agentFor(closed)
+	closed.Close()
+
+	l, err = agent.Liveness(time.Second)
+	if err == nil || l.Reachable || l.At.IsZero() {
+		t.Fatalf("Expected an unreachable agent, got %+v (%v)", l, err)
+	}
+}
+
+func TestKeepAliveAgent(t *testing.T) {
+	respond := func(trailer string, keepAlive bool) *Agent {
+		return agentFor(newRawServer(t, func(conn net.Conn) {
+			conn.Read(make([]byte, 512))
+			conn.Write(append(encodeFrame([]byte("1")), trailer...))
+			if keepAlive {
+				// Wait for the client to give up on the connection
+				conn.Read(make([]byte, 512))
+			}
+		}))
+	}
+
+	start := time.Now()
+	res, err := respond("", true).Query("agent.ping", 5*time.Second)
+	if err != nil || res.String() != "1" {
+		t.Fatal("Unexpected response:", res, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("Query waited for the agent to close the connection")
+	}
+
+	agent := respond("", false)
+	agent.ExpectConnectionClose = true
+	if _, err := agent.Query("agent.ping", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	agent = respond("extra", false)
+	agent.ExpectConnectionClose = true
+	if _, err := agent.Query("agent.ping", time.Second); err != ErrTrailingData {
+		t.Fatal("Expected ErrTrailingData, got:", err)
+	}
+
+	agent = respond("", true)
+	agent.ExpectConnectionClose = true
+	var netErr net.Error
+	if _, err := agent.Query("agent.ping", 100*time.Millisecond); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatal("Expected a timeout, got:", err)
+	}
+}
+
+func TestGetFirstSupported(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"system.cpu.util[,iowait]": "1.5",
+	})
+	agent := fake.agent()
+
+	res, err := agent.GetFirstSupported([]string{"system.cpu.iowait", "system.cpu.util[,iowait]"}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.String() != "1.5" {
+		t.Fatal("Unexpected value:", res.String())
+	}
+
+	_, err = agent.GetFirstSupported([]string{"missing.one", "missing.two"}, time.Second)
+	var nsErr *NotSupportedError
+	if !errors.As(err, &nsErr) || nsErr.Key != "missing.two" {
+		t.Fatal("Expected a NotSupportedError for the last key, got:", err)
+	}
+
+	// Count the keys sent, not the TLS check made after an empty response
+	var keys int32
+	rejecting := agentFor(newRawServer(t, func(conn net.Conn) {
+		first := make([]byte, 1)
+		if _, err := conn.Read(first); err == nil && first[0] != 0x16 {
+			atomic.AddInt32(&keys, 1)
+		}
+	}))
+	if _, err := rejecting.GetFirstSupported([]string{"a", "b"}, time.Second); !errors.Is(err, ErrEmptyResponse) {
+		t.Fatal("Expected ErrEmptyResponse, got:", err)
+	}
+	if atomic.LoadInt32(&keys) != 1 {
+		t.Fatal("Expected to stop after the first error, got keys:", keys)
+	}
+}
+
+func TestGetNormalized(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"vm.memory.size[pused]": "42.5",
+		"vm.memory.size[free]":  "not a number",
+	}).agent()
+
+	// The old key reported a fraction, the new one a percentage
+	spec := MetricSpec{
+		Keys: []string{"vm.memory.utilization", "vm.memory.size[pused]"},
+		Transform: func(res *Response) (float64, error) {
+			pct, err := res.Float64()
+			return pct / 100, err
+		},
+	}
+
+	v, err := agent.GetNormalized(spec, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 0.425 {
+		t.Fatal("Expected 0.425, got:", v)
+	}
+
+	if v, err := agent.GetNormalized(MetricSpec{Keys: []string{"vm.memory.size[pused]"}}, time.Second); err != nil || v != 42.5 {
+		t.Fatal("Expected the raw value without a transform, got:", v, err)
+	}
+
+	_, err = agent.GetNormalized(MetricSpec{Keys: []string{"vm.memory.size[free]"}}, time.Second)
+	if err == nil || !strings.HasPrefix(err.Error(), "vm.memory.size[free]: ") {
+		t.Fatal("Expected a transform error naming the key, got:", err)
+	}
+
+	_, err = agent.GetNormalized(MetricSpec{Keys: []string{"missing"}}, time.Second)
+	var nsErr *NotSupportedError
+	if !errors.As(err, &nsErr) {
+		t.Fatal("Expected a NotSupportedError, got:", err)
+	}
+}
+
+func TestGetTypedGeneric(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"proc.num[]":                      "312",
+		"systemd.unit.get[nginx.service]": `{"Id": "nginx.service", "ActiveState": "active"}`,
+	}).agent()
+
+	n, err := GetTyped(agent, "proc.num[]", func(b []byte) (int, error) { return strconv.Atoi(string(b)) }, time.Second)
+	if err != nil || n != 312 {
+		t.Fatal("Expected 312, got:", n, err)
+	}
+
+	decodeUnit := func(b []byte) (SystemdUnit, error) {
+		var unit SystemdUnit
+		err := json.Unmarshal(b, &unit)
+		return unit, err
+	}
+
+	unit, err := GetTyped(agent, "systemd.unit.get[nginx.service]", decodeUnit, time.Second)
+	if err != nil || unit.Id != "nginx.service" || unit.ActiveState != "active" {
+		t.Fatalf("Unexpected unit: %+v (%v)", unit, err)
+	}
+
+	// Parse errors name the key and the zero value is returned
+	var typeErr *json.UnmarshalTypeError
+	unit, err = GetTyped(agent, "proc.num[]", decodeUnit, time.Second)
+	if !errors.As(err, &typeErr) || !strings.HasPrefix(err.Error(), "proc.num[]: ") || unit.Id != "" {
+		t.Fatal("Expected a parse error, got:", unit, err)
+	}
+
+	var nsErr *NotSupportedError
+	if _, err := GetTyped(agent, "missing", decodeUnit, time.Second); !errors.As(err, &nsErr) {
+		t.Fatal("Expected a NotSupportedError, got:", err)
+	}
+}
+
+func TestAllowedKeys(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"agent.ping":                "1",
+		"agent.version":             "7.0.0",
+		"system.cpu.util[,idle]":    "97.5",
+		"system.run[rm -rf /tmp/x]": "",
+	})
+	agent := fake.agent()
+	agent.AllowedKeys = []string{"agent.*", "system.cpu.*"}
+
+	for _, key := range []string{"agent.ping", "system.cpu.util[,idle]"} {
+		if _, err := agent.Query(key, time.Second); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+
+	if _, err := agent.Query("system.run[rm -rf /tmp/x]", time.Second); !errors.Is(err, ErrKeyNotAllowed) {
+		t.Error("Expected ErrKeyNotAllowed, got:", err)
+	}
+	if _, err := agent.QueryContext(context.Background(), "system.run[rm -rf /tmp/x]"); !errors.Is(err, ErrKeyNotAllowed) {
+		t.Error("Expected ErrKeyNotAllowed, got:", err)
+	}
+
+	agent.AllowRemoteCommands = true
+	if _, err := agent.Run(context.Background(), "rm -rf /tmp/x", RunOptions{}); !errors.Is(err, ErrKeyNotAllowed) {
+		t.Error("Expected Run to be refused too, got:", err)
+	}
+
+	for _, key := range fake.received() {
+		if strings.HasPrefix(key, "system.run") {
+			t.Fatal("A refused key was sent:", key)
+		}
+	}
+
+	// Internal probes aren't subject to the allowlist
+	agent.AllowedKeys = []string{"system.cpu.*"}
+	agent.Framing = FramingAuto
+	if _, err := agent.Query("system.cpu.util[,idle]", time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAgentIP(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "1"}).agent()
+
+	// .invalid never resolves so the query only works if DNS is skipped
+	agent := &Agent{Host: "agent.invalid", IP: net.ParseIP("127.0.0.1"), Port: fake.Port}
+	if ok, err := agent.AgentPing(time.Second); err != nil || !ok {
+		t.Fatal("Expected to reach the agent by IP, got:", ok, err)
+	}
+	if agent.String() != "agent.invalid:"+strconv.Itoa(fake.Port) {
+		t.Fatal("The agent should still be named by Host, got:", agent.String())
+	}
+
+	agent.IP = nil
+	if _, err := agent.AgentPing(time.Second); err == nil {
+		t.Fatal("Expected agent.invalid not to resolve")
+	}
+}
+
+func TestGetBytes(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"vfs.file.contents[/etc/motd]": "hello\x00world",
+		"custom.key":                   NotSupported + "\x00Unsupported item key.",
+	}).agent()
+
+	data, err := agent.GetBytes("vfs.file.contents[/etc/motd]", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("hello\x00world")) {
+		t.Fatalf("Unexpected data: %q", data)
+	}
+
+	_, err = agent.GetBytes("custom.key", time.Second)
+	var nsErr *NotSupportedError
+	if !errors.As(err, &nsErr) || nsErr.Key != "custom.key" || nsErr.Reason != "Unsupported item key." {
+		t.Fatal("Expected a NotSupportedError, got:", err)
+	}
+}
+
+func TestNewAgentFromAddr(t *testing.T) {
+	tests := []struct {
+		addr, host string
+		port       int
+		str        string
+	}{
+		{"web01", "web01", 10050, "web01:10050"},
+		{"web01:10051", "web01", 10051, "web01:10051"},
+		{"192.0.2.1:10050", "192.0.2.1", 10050, "192.0.2.1:10050"},
+		{"fe80::1%mgmt0", "fe80::1%mgmt0", 10050, "[fe80::1%mgmt0]:10050"},
+		{"[fe80::1%mgmt0]", "fe80::1%mgmt0", 10050, "[fe80::1%mgmt0]:10050"},
+		{"[fe80::1%mgmt0]:10051", "fe80::1%mgmt0", 10051, "[fe80::1%mgmt0]:10051"},
+	}
+
+	for _, test := range tests {
+		agent, err := NewAgentFromAddr(test.addr)
+		if err != nil {
+			t.Fatal(test.addr, err)
+		}
+
+		if agent.Host != test.host || agent.Port != test.port || agent.String() != test.str {
+			t.Errorf("%s: unexpected agent %s (host %q, port %d)", test.addr, agent, agent.Host, agent.Port)
+		}
+	}
+
+	for _, addr := range []string{"", "web01:port", "[fe80::1%mgmt0", "fe80::zz%mgmt0"} {
+		if _, err := NewAgentFromAddr(addr); err == nil {
+			t.Errorf("%q: expected an error", addr)
+		}
+	}
+}
+
+func TestMissingZone(t *testing.T) {
+	agent, _ := NewAgentFromAddr("[fe80::1%zagent-missing0]:10050")
+
+	_, err := agent.Query("agent.ping", time.Second)
+	if err == nil || !strings.Contains(err.Error(), "zone zagent-missing0") {
+		t.Fatal("Expected an error mentioning the zone, got:", err)
+	}
+}
+
+func TestScopedAddress(t *testing.T) {
+	lo, err := net.InterfaceByIndex(1)
+	if err != nil || lo.Flags&net.FlagLoopback == 0 {
+		t.Skip("No loopback interface at index 1")
+	}
+
+	probe, err := net.Listen("tcp6", "[::1%"+lo.Name+"]:0")
+	if err != nil {
+		t.Skip("Scoped IPv6 listeners aren't supported:", err)
+	}
+	probe.Close()
+
+	agent := newFakeAgent(t, "tcp6", "[::1%"+lo.Name+"]:0", map[string]string{"agent.ping": "1"}).agent()
+	agent.Host = "::1%" + lo.Name
+
+	ok, err := agent.AgentPing(time.Second)
+	if err != nil || !ok {
+		t.Fatal("Couldn't ping over a scoped address:", err)
+	}
+}
+
+func TestQueryContextDefaultTimeout(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "1"})
+	fake.script("agent.ping", fakeScript{headerDelay: 2 * time.Second})
+
+	defer func(timeout time.Duration) { DefaultTimeout = timeout }(DefaultTimeout)
+	DefaultTimeout = 100 * time.Millisecond
+
+	// Neither the context nor the agent has a timeout
+	within(t, time.Second, func() {
+		if _, err := fake.agent().QueryContext(context.Background(), "agent.ping"); err != context.DeadlineExceeded && !isTimeout(err) {
+			t.Error("Expected a timeout, got:", err)
+		}
+	})
+}
+
+func TestClone(t *testing.T) {
+	// Set every exported field, so new options are checked too
+	agent := &Agent{}
+	v := reflect.ValueOf(agent).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if !v.Type().Field(i).IsExported() {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString("x")
+		case reflect.Bool:
+			field.SetBool(true)
+		case reflect.Int, reflect.Int64:
+			field.SetInt(1)
+		case reflect.Uint64:
+			field.SetUint(1)
+		case reflect.Float64:
+			field.SetFloat(1)
+		case reflect.Slice:
+			field.Set(reflect.MakeSlice(field.Type(), 1, 1))
+		case reflect.Map:
+			field.Set(reflect.MakeMap(field.Type()))
+		case reflect.Ptr:
+			field.Set(reflect.New(field.Type().Elem()))
+		case reflect.Func:
+			field.Set(reflect.MakeFunc(field.Type(), func([]reflect.Value) []reflect.Value { return nil }))
+		default:
+			t.Fatalf("Can't set %s of kind %s", v.Type().Field(i).Name, field.Kind())
+		}
+	}
+
+	clone := reflect.ValueOf(agent.clone()).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).IsExported() && clone.Field(i).IsZero() {
+			t.Error("clone doesn't copy", v.Type().Field(i).Name)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package zagent
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+	ByteBudget limits the total size of responses being read at once by
+	every Agent sharing it through Agent.ByteBudget, to bound memory when
+	many agents return large values together. A response whose declared
+	size would exceed the budget waits until enough earlier responses
+	have been read, or its context is done. Responses larger than the
+	whole budget are read once nothing else is. Waiters are served in
+	order so large responses aren't starved by small ones.
+*/
+type ByteBudget struct {
+	mu      sync.Mutex
+	limit   uint64
+	used    uint64
+	waiters []*budgetWaiter
+}
+
+type budgetWaiter struct {
+	n     uint64
+	ready chan struct{}
+}
+
+// Creates a ByteBudget allowing limit bytes in flight.
+func NewByteBudget(limit uint64) *ByteBudget {
+	return &ByteBudget{limit: limit}
+}
+
+// Returns the number of bytes currently reserved.
+func (b *ByteBudget) InUse() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+/*
+	Wait for n bytes of the budget, or the whole budget if n is larger,
+	and return how many were reserved. They must be given back with
+	release.
+*/
+func (b *ByteBudget) acquire(ctx context.Context, n uint64) (uint64, error) {
+	n = min(n, b.limit)
+
+	b.mu.Lock()
+	if len(b.waiters) == 0 && b.used+n <= b.limit {
+		b.used += n
+		b.mu.Unlock()
+		return n, nil
+	}
+
+	w := &budgetWaiter{n: n, ready: make(chan struct{})}
+	b.waiters = append(b.waiters, w)
+	b.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return n, nil
+	case <-ctx.Done():
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-w.ready:
+		// Granted while we were giving up, hand it back
+		b.used -= n
+	default:
+		for i, other := range b.waiters {
+			if other == w {
+				b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+				break
+			}
+		}
+	}
+	b.wake()
+
+	return 0, ctx.Err()
+}
+
+// Return n bytes to the budget.
+func (b *ByteBudget) release(n uint64) {
+	if n == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	b.wake()
+}
+
+// Grant waiters in order while they fit. b.mu must be held.
+func (b *ByteBudget) wake() {
+	for len(b.waiters) > 0 {
+		w := b.waiters[0]
+		if b.used+w.n > b.limit {
+			return
+		}
+		b.used += w.n
+		b.waiters = b.waiters[1:]
+		close(w.ready)
+	}
+}
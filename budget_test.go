@@ -0,0 +1,98 @@
+package zagent
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestByteBudget(t *testing.T) {
+	budget := NewByteBudget(64 << 10)
+
+	var maxInUse uint64
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if n := budget.InUse(); n > atomic.LoadUint64(&maxInUse) {
+				atomic.StoreUint64(&maxInUse, n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// Each response fits the budget alone but no two fit together
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		agent := agentFor(newSlowServer(t, 48<<10, 2*time.Millisecond))
+		agent.ByteBudget = budget
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = agent.Query("vfs.file.contents[/var/log/big]", 10*time.Second)
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Query %d: %v", i, err)
+		}
+	}
+	if n := atomic.LoadUint64(&maxInUse); n == 0 || n > 48<<10 {
+		t.Fatal("Expected responses to be read one at a time, peak in use:", n)
+	}
+	if n := budget.InUse(); n != 0 {
+		t.Fatal("Expected the budget to be returned, still in use:", n)
+	}
+}
+
+func TestByteBudgetContext(t *testing.T) {
+	budget := NewByteBudget(1 << 10)
+	held, _ := budget.acquire(context.Background(), 1<<20)
+	if held != 1<<10 {
+		t.Fatal("Oversized reservations should take the whole budget, got:", held)
+	}
+
+	agent := agentFor(newSlowServer(t, 100, 0))
+	agent.ByteBudget = budget
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := agent.QueryContext(ctx, "agent.ping"); err != context.DeadlineExceeded {
+		t.Fatal("Expected context.DeadlineExceeded, got:", err)
+	}
+
+	budget.release(held)
+	if _, err := agent.Query("agent.ping", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := budget.InUse(); n != 0 {
+		t.Fatal("Expected the budget to be returned, still in use:", n)
+	}
+}
+
+func TestByteBudgetJSON(t *testing.T) {
+	agent := &Agent{Host: "web01", Port: DefaultPort, ByteBudget: NewByteBudget(1 << 10)}
+
+	out, err := json.Marshal(agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A zero ByteBudget would silently be unlimited
+	var roundTrip Agent
+	if err := json.Unmarshal(out, &roundTrip); err != nil || roundTrip.ByteBudget != nil {
+		t.Fatalf("Expected ByteBudget to be left out, got: %s (%v)", out, err)
+	}
+}
@@ -0,0 +1,224 @@
+package zagent
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Querier runs a check (key) against a zabbix agent. It's implemented by
+// *Agent and *Cache.
+type Querier interface {
+	Query(key string, timeout time.Duration) (*Response, error)
+}
+
+// CacheTTL sets the TTL of every key matching Pattern, where * matches any
+// sequence of characters (e.g. "agent.*" or "system.sw.*").
+type CacheTTL struct {
+	Pattern string
+	TTL     time.Duration
+}
+
+// CacheOptions configures a Cache.
+type CacheOptions struct {
+	TTL         time.Duration // TTL of keys not matching any of TTLs
+	TTLs        []CacheTTL    // Per key TTLs, the first matching pattern wins
+	NegativeTTL time.Duration // TTL of errors. Errors aren't cached if < 1.
+	MaxEntries  int           // Least recently used entries are evicted beyond this. Defaults to 1024.
+}
+
+/*
+	Cache wraps a Querier and caches its responses for slowly changing
+	keys such as agent.version. Concurrent misses for the same key share a
+	single query. Responses returned from the cache have FromCache set.
+*/
+type Cache struct {
+	q    Querier
+	opts CacheOptions
+	now  func() time.Time
+
+	mu       sync.Mutex
+	lru      *list.List // of *cacheEntry, most recently used first
+	entries  map[string]*list.Element
+	inflight map[string]*cacheCall
+}
+
+type cacheEntry struct {
+	key     string
+	res     *Response
+	err     error
+	expires time.Time
+}
+
+type cacheCall struct {
+	wg  sync.WaitGroup
+	res *Response
+	err error
+}
+
+// Creates a new Cache in front of q.
+func NewCache(q Querier, opts CacheOptions) *Cache {
+	if opts.MaxEntries < 1 {
+		opts.MaxEntries = 1024
+	}
+
+	return &Cache{
+		q:        q,
+		opts:     opts,
+		now:      time.Now,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*cacheCall),
+	}
+}
+
+// Returns the cached response for key or queries it if missing or expired.
+func (c *Cache) Query(key string, timeout time.Duration) (*Response, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		if c.now().Before(entry.expires) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return entry.response()
+		}
+	}
+	c.mu.Unlock()
+
+	return c.fetch(key, timeout)
+}
+
+// Query key bypassing the cache and store the fresh result.
+func (c *Cache) Refresh(key string, timeout time.Duration) (*Response, error) {
+	return c.fetch(key, timeout)
+}
+
+// Remove every cached entry.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// Returns the number of cached entries, including expired ones not yet evicted.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Query key, sharing the result with any concurrent fetches of the same key.
+func (c *Cache) fetch(key string, timeout time.Duration) (*Response, error) {
+	c.mu.Lock()
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		call.wg.Wait()
+		return call.res, call.err
+	}
+
+	call := &cacheCall{}
+	call.wg.Add(1)
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	res, err := c.q.Query(key, timeout)
+	fetchedAt := c.now()
+	if res != nil {
+		res.FetchedAt = fetchedAt
+	}
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.store(&cacheEntry{key: key, res: res, err: err}, fetchedAt)
+	c.mu.Unlock()
+
+	call.res, call.err = res, err
+	call.wg.Done()
+
+	return res, err
+}
+
+// Add entry to the cache, evicting the least recently used entries if full.
+// The caller must hold c.mu.
+func (c *Cache) store(entry *cacheEntry, fetchedAt time.Time) {
+	ttl := c.ttl(entry.key)
+	if entry.err != nil {
+		ttl = c.opts.NegativeTTL
+	}
+
+	if el, ok := c.entries[entry.key]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, entry.key)
+	}
+
+	if ttl < 1 {
+		return
+	}
+
+	// Keep our own copy so callers modifying the response don't alter the cache
+	if entry.res != nil {
+		res := *entry.res
+		res.Data = append([]byte(nil), res.Data...)
+		entry.res = &res
+	}
+
+	entry.expires = fetchedAt.Add(ttl)
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.opts.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Returns the TTL for key.
+func (c *Cache) ttl(key string) time.Duration {
+	for _, t := range c.opts.TTLs {
+		if matchKey(t.Pattern, key) {
+			return t.TTL
+		}
+	}
+	return c.opts.TTL
+}
+
+// Returns a copy of the cached response marked as coming from the cache.
+func (e *cacheEntry) response() (*Response, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+
+	res := *e.res
+	res.Data = append([]byte(nil), res.Data...)
+	res.FromCache = true
+	return &res, nil
+}
+
+// Returns true if key matches pattern, where * matches any sequence of characters.
+func matchKey(pattern, key string) bool {
+	// Classic wildcard matching with backtracking to the last *
+	p, k := 0, 0
+	star, mark := -1, 0
+	for k < len(key) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, k
+			p++
+		case p < len(pattern) && pattern[p] == key[k]:
+			p++
+			k++
+		case star >= 0:
+			mark++
+			p, k = star+1, mark
+		default:
+			return false
+		}
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
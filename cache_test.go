@@ -0,0 +1,170 @@
+package zagent
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingQuerier counts queries per key and optionally blocks them.
+type countingQuerier struct {
+	mu      sync.Mutex
+	counts  map[string]int
+	release chan struct{}
+	err     error
+}
+
+func (q *countingQuerier) Query(key string, timeout time.Duration) (*Response, error) {
+	q.mu.Lock()
+	q.counts[key]++
+	q.mu.Unlock()
+
+	if q.release != nil {
+		<-q.release
+	}
+
+	if q.err != nil {
+		return nil, q.err
+	}
+	return &Response{Data: []byte("value of " + key)}, nil
+}
+
+func (q *countingQuerier) count(key string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.counts[key]
+}
+
+func TestCacheTTL(t *testing.T) {
+	q := &countingQuerier{counts: map[string]int{}}
+	cache := NewCache(q, CacheOptions{
+		TTL:  time.Second,
+		TTLs: []CacheTTL{{Pattern: "agent.*", TTL: time.Minute}},
+	})
+
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		cache.Query("agent.version", 0)
+		cache.Query("system.uptime", 0)
+	}
+
+	res, err := cache.Query("agent.version", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.FromCache || !res.FetchedAt.Equal(now) {
+		t.Fatalf("Expected a cached response fetched at %v, got %+v", now, res)
+	}
+
+	now = now.Add(2 * time.Second)
+	cache.Query("agent.version", 0)
+	cache.Query("system.uptime", 0)
+
+	if n := q.count("agent.version"); n != 1 {
+		t.Fatal("agent.version should have been queried once, got", n)
+	}
+
+	if n := q.count("system.uptime"); n != 2 {
+		t.Fatal("system.uptime should have been queried twice, got", n)
+	}
+
+	res, _ = cache.Refresh("agent.version", 0)
+	if res.FromCache || q.count("agent.version") != 2 {
+		t.Fatal("Refresh should bypass the cache")
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	q := &countingQuerier{counts: map[string]int{}}
+	cache := NewCache(q, CacheOptions{TTL: time.Minute, MaxEntries: 2})
+
+	cache.Query("a", 0)
+	cache.Query("b", 0)
+	cache.Query("a", 0) // a is now the most recently used
+	cache.Query("c", 0) // evicts b
+
+	if cache.Len() != 2 {
+		t.Fatal("Expected 2 entries, got", cache.Len())
+	}
+
+	cache.Query("a", 0)
+	cache.Query("b", 0)
+
+	if q.count("a") != 1 || q.count("b") != 2 {
+		t.Fatalf("Expected b to be evicted, counts: %v", q.counts)
+	}
+}
+
+func TestCacheSingleflight(t *testing.T) {
+	q := &countingQuerier{counts: map[string]int{}, release: make(chan struct{})}
+	cache := NewCache(q, CacheOptions{TTL: time.Minute})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.Query("agent.version", 0); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// Give the goroutines a chance to pile up behind the first query
+	time.Sleep(50 * time.Millisecond)
+	close(q.release)
+	wg.Wait()
+
+	if n := q.count("agent.version"); n != 1 {
+		t.Fatal("Concurrent misses should share one query, got", n)
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	errDown := errors.New("agent down")
+	q := &countingQuerier{counts: map[string]int{}, err: errDown}
+	cache := NewCache(q, CacheOptions{TTL: time.Minute, NegativeTTL: time.Second})
+
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, err := cache.Query("agent.ping", 0); err != errDown {
+			t.Fatal("Expected the cached error, got:", err)
+		}
+	}
+
+	if n := q.count("agent.ping"); n != 1 {
+		t.Fatal("The error should have been cached, got queries:", n)
+	}
+
+	now = now.Add(2 * time.Second)
+	cache.Query("agent.ping", 0)
+	if n := q.count("agent.ping"); n != 2 {
+		t.Fatal("The error should have expired, got queries:", n)
+	}
+}
+
+func TestMatchKey(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"agent.*", "agent.version", true},
+		{"agent.*", "system.uptime", false},
+		{"vfs.fs.size[*]", "vfs.fs.size[/var/log,free]", true},
+		{"*.discovery", "net.if.discovery", true},
+		{"system.cpu.load", "system.cpu.load", true},
+		{"system.cpu.load", "system.cpu.load[all]", false},
+	}
+
+	for _, test := range tests {
+		if matchKey(test.pattern, test.key) != test.match {
+			t.Errorf("matchKey(%q, %q) should be %v", test.pattern, test.key, test.match)
+		}
+	}
+}
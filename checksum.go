@@ -0,0 +1,186 @@
+package zagent
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Returned by FileChecksum when the agent's version can't compute the algorithm.
+var ErrUnsupportedAlgorithm = errors.New("checksum algorithm not supported by agent")
+
+// ChecksumAlgorithm is a vfs.file.cksum mode.
+type ChecksumAlgorithm string
+
+const (
+	ChecksumCRC32  ChecksumAlgorithm = "crc32" // The POSIX cksum CRC, not IEEE CRC-32
+	ChecksumMD5    ChecksumAlgorithm = "md5"
+	ChecksumSHA256 ChecksumAlgorithm = "sha256"
+)
+
+// Returns the digest size in bytes, 0 for unknown algorithms.
+func (alg ChecksumAlgorithm) size() int {
+	switch alg {
+	case ChecksumCRC32:
+		return 4
+	case ChecksumMD5:
+		return md5.Size
+	case ChecksumSHA256:
+		return sha256.Size
+	}
+	return 0
+}
+
+// Returns a new hash computing the algorithm locally.
+func (alg ChecksumAlgorithm) hash() hash.Hash {
+	switch alg {
+	case ChecksumMD5:
+		return md5.New()
+	case ChecksumSHA256:
+		return sha256.New()
+	}
+	return &cksum{}
+}
+
+// Checksum is the checksum of a file on the agent.
+type Checksum struct {
+	Algorithm ChecksumAlgorithm
+	Hex       string // Lower case, CRCs are zero padded to 8 digits
+	Bytes     []byte
+}
+
+// Returns true if s is the same checksum in hex, ignoring case.
+func (c *Checksum) EqualHex(s string) bool {
+	return strings.EqualFold(c.Hex, s)
+}
+
+// Checksum everything read from r locally and return true if it matches.
+func (c *Checksum) Matches(r io.Reader) (bool, error) {
+	h := c.Algorithm.hash()
+	if _, err := io.Copy(h, r); err != nil {
+		return false, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)) == c.Hex, nil
+}
+
+/*
+	Checksum the file at path on the agent. vfs.file.cksum only takes a
+	mode since 6.0, so on older agents CRC32 uses the plain key, MD5 falls
+	back to vfs.file.md5sum and SHA256 returns ErrUnsupportedAlgorithm.
+	The agent's reply is checked to be a digest of the right length.
+*/
+func (a *Agent) FileChecksum(ctx context.Context, path string, alg ChecksumAlgorithm) (*Checksum, error) {
+	if alg.size() == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, alg)
+	}
+
+	key := BuildKey("vfs.file.cksum", path)
+	if alg != ChecksumCRC32 {
+		res, err := a.QueryContext(ctx, "agent.version")
+		if err != nil {
+			return nil, err
+		}
+
+		major, _, ok := majorMinor(res.String())
+		switch {
+		case ok && major >= 6:
+			key = BuildKey("vfs.file.cksum", path, string(alg))
+		case alg == ChecksumMD5:
+			key = BuildKey("vfs.file.md5sum", path)
+		default:
+			return nil, fmt.Errorf("%w: %s on agent %s", ErrUnsupportedAlgorithm, alg, res.String())
+		}
+	}
+
+	res, err := a.QueryContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := res.notSupportedError(key); err != nil {
+		return nil, err
+	}
+
+	return parseChecksum(alg, strings.TrimSpace(res.String()))
+}
+
+// Parse a decimal CRC or hex digest as returned by the agent.
+func parseChecksum(alg ChecksumAlgorithm, value string) (*Checksum, error) {
+	c := &Checksum{Algorithm: alg}
+
+	if alg == ChecksumCRC32 {
+		crc, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid crc32 checksum %q: %w", value, err)
+		}
+		c.Bytes = binary.BigEndian.AppendUint32(nil, uint32(crc))
+		c.Hex = hex.EncodeToString(c.Bytes)
+		return c, nil
+	}
+
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) != alg.size() {
+		return nil, fmt.Errorf("invalid %s checksum %q", alg, value)
+	}
+	c.Bytes = b
+	c.Hex = strings.ToLower(value)
+
+	return c, nil
+}
+
+/*
+	cksum is the CRC computed by POSIX cksum and the agent's crc32 mode:
+	polynomial 0x04C11DB7, most significant bit first, with the data's
+	length appended and the result inverted.
+*/
+type cksum struct {
+	crc uint32
+	n   uint64
+}
+
+var cksumTable = func() (table [256]uint32) {
+	for i := range table {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04c11db7
+			} else {
+				c <<= 1
+			}
+		}
+		table[i] = c
+	}
+	return table
+}()
+
+func (c *cksum) update(b byte) {
+	c.crc = c.crc<<8 ^ cksumTable[byte(c.crc>>24)^b]
+}
+
+func (c *cksum) Write(p []byte) (int, error) {
+	for _, b := range p {
+		c.update(b)
+	}
+	c.n += uint64(len(p))
+	return len(p), nil
+}
+
+func (c *cksum) Sum(b []byte) []byte {
+	final := *c
+	for n := c.n; n > 0; n >>= 8 {
+		final.update(byte(n))
+	}
+	return binary.BigEndian.AppendUint32(b, ^final.crc)
+}
+
+func (c *cksum) Reset()         { *c = cksum{} }
+func (c *cksum) Size() int      { return 4 }
+func (c *cksum) BlockSize() int { return 1 }
@@ -0,0 +1,68 @@
+package zagent
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCksum(t *testing.T) {
+	tests := map[string]string{
+		"":        "ffffffff", // 4294967295
+		"hello\n": "b3beab91", // 3015617425
+	}
+
+	for data, want := range tests {
+		c := &Checksum{Algorithm: ChecksumCRC32, Hex: want}
+		if ok, err := c.Matches(strings.NewReader(data)); err != nil || !ok {
+			t.Errorf("%q: expected cksum %s", data, want)
+		}
+	}
+}
+
+func TestFileChecksum(t *testing.T) {
+	newAgent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"agent.version":                     "6.0.21",
+		"vfs.file.cksum[/etc/hosts]":        "3015617425",
+		"vfs.file.cksum[/etc/hosts,md5]":    "B1946AC92492D2347C6235B4D2611184",
+		"vfs.file.cksum[/etc/hosts,sha256]": "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+		"vfs.file.cksum[/etc/short,sha256]": "5891b5b5",
+	}).agent()
+
+	oldAgent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"agent.version":               "5.0.1",
+		"vfs.file.md5sum[/etc/hosts]": "b1946ac92492d2347c6235b4d2611184",
+	}).agent()
+
+	for _, agent := range []*Agent{newAgent, oldAgent} {
+		c, err := agent.FileChecksum(context.Background(), "/etc/hosts", ChecksumMD5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.EqualHex("B1946AC92492D2347C6235B4D2611184") || len(c.Bytes) != 16 {
+			t.Fatalf("Unexpected checksum: %+v", c)
+		}
+		if ok, _ := c.Matches(strings.NewReader("hello\n")); !ok {
+			t.Fatal("Expected the local data to match")
+		}
+	}
+
+	for _, alg := range []ChecksumAlgorithm{ChecksumCRC32, ChecksumSHA256} {
+		c, err := newAgent.FileChecksum(context.Background(), "/etc/hosts", alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := c.Matches(strings.NewReader("hello\n")); !ok {
+			t.Fatalf("%s: expected the local data to match %s", alg, c.Hex)
+		}
+	}
+
+	if _, err := oldAgent.FileChecksum(context.Background(), "/etc/hosts", ChecksumSHA256); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Fatal("Expected ErrUnsupportedAlgorithm, got:", err)
+	}
+
+	if _, err := newAgent.FileChecksum(context.Background(), "/etc/short", ChecksumSHA256); err == nil {
+		t.Fatal("Expected a short digest to be rejected")
+	}
+}
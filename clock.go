@@ -0,0 +1,58 @@
+package zagent
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Skew is the estimated difference between the agent's clock and ours.
+type Skew struct {
+	Skew        time.Duration // Agent clock minus local clock
+	Uncertainty time.Duration // Skew is accurate to within ±Uncertainty
+	RTT         time.Duration // Round trip time of the sample used
+}
+
+/*
+	Estimate the agent's clock skew by querying system.localtime[utc]
+	samples times (at least once) and taking the median. Each sample
+	assumes the agent read its clock half way through the round trip so
+	the uncertainty is half the RTT plus half a second, since the agent
+	only reports whole seconds.
+*/
+func (a *Agent) ClockSkew(ctx context.Context, samples int) (Skew, error) {
+	if samples < 1 {
+		samples = 1
+	}
+
+	skews := make([]Skew, 0, samples)
+	for i := 0; i < samples; i++ {
+		start := time.Now()
+		res, err := a.QueryContext(ctx, "system.localtime[utc]")
+		if err != nil {
+			return Skew{}, err
+		}
+		rtt := time.Since(start)
+
+		if err := res.notSupportedError("system.localtime[utc]"); err != nil {
+			return Skew{}, err
+		}
+
+		secs, err := strconv.ParseInt(res.String(), 10, 64)
+		if err != nil {
+			return Skew{}, err
+		}
+
+		// The agent's clock was somewhere in [secs, secs+1)
+		agentTime := time.Unix(secs, int64(500*time.Millisecond))
+		skews = append(skews, Skew{
+			Skew:        agentTime.Sub(start.Add(rtt / 2)),
+			Uncertainty: rtt/2 + 500*time.Millisecond,
+			RTT:         rtt,
+		})
+	}
+
+	sort.Slice(skews, func(i, j int) bool { return skews[i].Skew < skews[j].Skew })
+	return skews[len(skews)/2], nil
+}
@@ -0,0 +1,39 @@
+package zagent
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestClockSkew(t *testing.T) {
+	fake := newFakeAgentFunc(t, "tcp", "127.0.0.1:0", func(key string) string {
+		if key != "system.localtime[utc]" {
+			return NotSupported
+		}
+		return strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	})
+
+	skew, err := fake.agent().ClockSkew(context.Background(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff := skew.Skew - time.Hour
+	if diff < 0 {
+		diff = -diff
+	}
+
+	if diff > skew.Uncertainty {
+		t.Fatalf("Expected a skew of 1h ± %v, got %v", skew.Uncertainty, skew.Skew)
+	}
+
+	if skew.RTT <= 0 || skew.Uncertainty < 500*time.Millisecond {
+		t.Fatalf("Unexpected sample: %+v", skew)
+	}
+
+	if len(fake.received()) != 5 {
+		t.Fatal("Expected 5 samples, got", len(fake.received()))
+	}
+}
@@ -0,0 +1,179 @@
+package zagent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KeyResult is the outcome of querying a single key.
+type KeyResult struct {
+	Response *Response
+	Err      error
+}
+
+// DiffOptions controls how values are compared by Diff.
+type DiffOptions struct {
+	TrimSpace bool // Ignore leading and trailing white space
+	SortLines bool // Ignore the order of lines, e.g. in package lists
+
+	// Normalize, if set, is applied to every value after the options above.
+	Normalize func(key, value string) string
+}
+
+// DiffReport is the result of comparing the same keys on two sides.
+type DiffReport struct {
+	Equal     []string    `json:"equal"`
+	Different []ValueDiff `json:"different"`
+	OnlyLeft  []string    `json:"only_left"`  // Missing or unsupported on the right
+	OnlyRight []string    `json:"only_right"` // Missing or unsupported on the left
+	Errored   []KeyError  `json:"errored"`
+}
+
+// ValueDiff is a key whose value differs between the two sides.
+type ValueDiff struct {
+	Key   string `json:"key"`
+	Left  string `json:"left"`
+	Right string `json:"right"`
+}
+
+// KeyError is a key that couldn't be queried on one or both sides.
+type KeyError struct {
+	Key   string `json:"key"`
+	Left  string `json:"left,omitempty"`
+	Right string `json:"right,omitempty"`
+}
+
+// Query every key and return the results keyed by key.
+func (a *Agent) Snapshot(keys []string, timeout time.Duration) map[string]KeyResult {
+	results := make(map[string]KeyResult, len(keys))
+	for _, key := range keys {
+		res, err := a.Query(key, timeout)
+		results[key] = KeyResult{Response: res, Err: err}
+	}
+	return results
+}
+
+// Snapshot keys on both agents and compare them, e.g. a golden host against a candidate.
+func DiffAgents(left, right *Agent, keys []string, timeout time.Duration, opts DiffOptions) *DiffReport {
+	return Diff(left.Snapshot(keys, timeout), right.Snapshot(keys, timeout), opts)
+}
+
+/*
+	Compare two sets of results key by key. A key absent from one side or
+	not supported by it counts as only being on the other side, keys with an
+	error on either side are reported as errored. Every list is sorted by key.
+*/
+func Diff(left, right map[string]KeyResult, opts DiffOptions) *DiffReport {
+	keys := map[string]bool{}
+	for key := range left {
+		keys[key] = true
+	}
+	for key := range right {
+		keys[key] = true
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	report := &DiffReport{}
+	for _, key := range sorted {
+		l, inLeft := left[key]
+		r, inRight := right[key]
+
+		if l.Err != nil || r.Err != nil {
+			report.Errored = append(report.Errored, KeyError{Key: key, Left: errString(l.Err), Right: errString(r.Err)})
+			continue
+		}
+
+		inLeft = inLeft && l.Response != nil && l.Response.Supported()
+		inRight = inRight && r.Response != nil && r.Response.Supported()
+
+		switch {
+		case !inLeft && !inRight:
+			report.Equal = append(report.Equal, key)
+		case !inRight:
+			report.OnlyLeft = append(report.OnlyLeft, key)
+		case !inLeft:
+			report.OnlyRight = append(report.OnlyRight, key)
+		default:
+			lv, rv := opts.normalize(key, l.Response.String()), opts.normalize(key, r.Response.String())
+			if lv == rv {
+				report.Equal = append(report.Equal, key)
+			} else {
+				report.Different = append(report.Different, ValueDiff{Key: key, Left: lv, Right: rv})
+			}
+		}
+	}
+
+	return report
+}
+
+// Returns true if no differences, one sided keys or errors were found.
+func (d *DiffReport) Clean() bool {
+	return len(d.Different) == 0 && len(d.OnlyLeft) == 0 && len(d.OnlyRight) == 0 && len(d.Errored) == 0
+}
+
+// Renders the report for humans, one line per key that isn't equal.
+func (d *DiffReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d equal, %d different, %d only left, %d only right, %d errored\n",
+		len(d.Equal), len(d.Different), len(d.OnlyLeft), len(d.OnlyRight), len(d.Errored))
+
+	for _, diff := range d.Different {
+		fmt.Fprintf(&b, "~ %s: %q != %q\n", diff.Key, diff.Left, diff.Right)
+	}
+	for _, key := range d.OnlyLeft {
+		fmt.Fprintf(&b, "- %s\n", key)
+	}
+	for _, key := range d.OnlyRight {
+		fmt.Fprintf(&b, "+ %s\n", key)
+	}
+	for _, e := range d.Errored {
+		fmt.Fprintf(&b, "! %s: left: %s, right: %s\n", e.Key, orNone(e.Left), orNone(e.Right))
+	}
+
+	return b.String()
+}
+
+// Apply the normalization options to value.
+func (o DiffOptions) normalize(key, value string) string {
+	if o.TrimSpace {
+		value = strings.TrimSpace(value)
+	}
+
+	if o.SortLines {
+		lines := strings.Split(value, "\n")
+		if o.TrimSpace {
+			for i := range lines {
+				lines[i] = strings.TrimSpace(lines[i])
+			}
+		}
+		sort.Strings(lines)
+		value = strings.Join(lines, "\n")
+	}
+
+	if o.Normalize != nil {
+		value = o.Normalize(key, value)
+	}
+
+	return value
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "ok"
+	}
+	return s
+}
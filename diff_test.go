@@ -0,0 +1,74 @@
+package zagent
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffAgents(t *testing.T) {
+	golden := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"system.sw.packages":     "bash\ncurl\nopenssl",
+		"kernel.maxproc":         "4194304",
+		"vfs.file.cksum[/etc/x]": "1234",
+		"system.sw.os":           "Linux 6.1",
+	}).agent()
+
+	candidate := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"system.sw.packages": "openssl\nbash\ncurl\n",
+		"kernel.maxproc":     "32768",
+		"net.tcp.listen[80]": "1",
+		"system.sw.os":       "Linux 6.1",
+	}).agent()
+
+	keys := []string{"system.sw.packages", "kernel.maxproc", "vfs.file.cksum[/etc/x]", "net.tcp.listen[80]", "system.sw.os"}
+	report := DiffAgents(golden, candidate, keys, time.Second, DiffOptions{TrimSpace: true, SortLines: true})
+
+	if !reflect.DeepEqual(report.Equal, []string{"system.sw.os", "system.sw.packages"}) {
+		t.Error("Unexpected equal keys:", report.Equal)
+	}
+
+	if !reflect.DeepEqual(report.Different, []ValueDiff{{"kernel.maxproc", "4194304", "32768"}}) {
+		t.Error("Unexpected differences:", report.Different)
+	}
+
+	if !reflect.DeepEqual(report.OnlyLeft, []string{"vfs.file.cksum[/etc/x]"}) ||
+		!reflect.DeepEqual(report.OnlyRight, []string{"net.tcp.listen[80]"}) {
+		t.Error("Unexpected one sided keys:", report.OnlyLeft, report.OnlyRight)
+	}
+
+	if report.Clean() {
+		t.Error("Report shouldn't be clean")
+	}
+
+	if _, err := json.Marshal(report); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(report.String(), `~ kernel.maxproc: "4194304" != "32768"`) {
+		t.Error("Unexpected rendering:\n" + report.String())
+	}
+}
+
+func TestDiffErrors(t *testing.T) {
+	left := map[string]KeyResult{
+		"agent.ping": {Err: errors.New("connection refused")},
+		"same":       {Response: &Response{Data: []byte("x")}},
+	}
+	right := map[string]KeyResult{
+		"agent.ping": {Response: &Response{Data: []byte("1")}},
+		"same":       {Response: &Response{Data: []byte("x")}},
+	}
+
+	report := Diff(left, right, DiffOptions{})
+	if len(report.Errored) != 1 || report.Errored[0].Left != "connection refused" || report.Errored[0].Right != "" {
+		t.Fatal("Unexpected errors:", report.Errored)
+	}
+
+	if !Diff(right, right, DiffOptions{}).Clean() {
+		t.Fatal("Identical results should be clean")
+	}
+}
@@ -0,0 +1,91 @@
+package zagent
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	DiscoveryCache caches low level discovery results (vfs.fs.discovery,
+	net.if.discovery and system.cpu.discovery) for agents that use it
+	through Agent.DiscoveryCache. Discovery changes far more slowly than
+	the values of what it discovers, so the Discover* helpers and
+	InterfaceTraffic can reuse it while their metrics are always fetched
+	fresh. One cache can be shared by many agents, entries are kept per
+	host:port so copies of an Agent share them.
+*/
+type DiscoveryCache struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	caches map[string]*discoveryEntry // By host:port
+}
+
+// The cache of one address, querying through the agent that last used it.
+type discoveryEntry struct {
+	cache *Cache
+	agent atomic.Pointer[Agent]
+}
+
+func (e *discoveryEntry) Query(key string, timeout time.Duration) (*Response, error) {
+	return e.agent.Load().Query(key, timeout)
+}
+
+// Creates a DiscoveryCache keeping discovery results for ttl.
+func NewDiscoveryCache(ttl time.Duration) *DiscoveryCache {
+	return &DiscoveryCache{ttl: ttl}
+}
+
+// Returns the TTL of cached discovery results.
+func (d *DiscoveryCache) TTL() time.Duration {
+	return d.ttl
+}
+
+// Forget every cached discovery result, e.g. after reconfiguring hosts.
+func (d *DiscoveryCache) Purge() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.caches = nil
+}
+
+// Returns the cache of agent's address, creating it on first use.
+func (d *DiscoveryCache) cache(agent *Agent) *Cache {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.caches == nil {
+		d.caches = make(map[string]*discoveryEntry)
+	}
+
+	addr := agent.hostPort()
+	e, ok := d.caches[addr]
+	if !ok {
+		e = &discoveryEntry{}
+		e.cache = NewCache(e, CacheOptions{TTL: d.ttl})
+		d.caches[addr] = e
+	}
+	e.agent.Store(agent)
+
+	return e.cache
+}
+
+/*
+	Query a discovery key, through the agent's DiscoveryCache if it has
+	one. With a cache the context only bounds the query's timeout.
+*/
+func (a *Agent) queryDiscovery(ctx context.Context, key string) (*Response, error) {
+	if a.DiscoveryCache == nil {
+		return a.QueryContext(ctx, key)
+	}
+
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	}
+
+	return a.DiscoveryCache.cache(a).Query(key, timeout)
+}
@@ -0,0 +1,81 @@
+package zagent
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryCache(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"vfs.fs.discovery": `{"data":[{"{#FSNAME}":"/","{#FSTYPE}":"ext4"}]}`,
+		"net.if.discovery": `[{"{#IFNAME}":"eth0"}]`,
+		"net.if.in[eth0]":  "1000",
+		"net.if.out[eth0]": "2000",
+	})
+	agent := fake.agent()
+	agent.DiscoveryCache = NewDiscoveryCache(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if fs, err := agent.DiscoverFilesystems(time.Second); err != nil || len(fs) != 1 || fs[0].Name != "/" {
+			t.Fatal("Unexpected filesystems:", fs, err)
+		}
+		if counters, err := agent.InterfaceTraffic(context.Background(), TrafficOptions{}); err != nil || len(counters) != 1 || counters[0].InBytes != 1000 {
+			t.Fatal("Unexpected counters:", counters, err)
+		}
+	}
+
+	counts := map[string]int{}
+	for _, key := range fake.received() {
+		counts[key]++
+	}
+	if counts["vfs.fs.discovery"] != 1 || counts["net.if.discovery"] != 1 {
+		t.Fatal("Expected each discovery to be queried once, got:", counts)
+	}
+	if counts["net.if.in[eth0]"] != 3 || counts["net.if.out[eth0]"] != 3 {
+		t.Fatal("Expected the metrics to be fetched every time, got:", counts)
+	}
+
+	before := len(fake.received())
+	agent.DiscoveryCache.Purge()
+	agent.DiscoverFilesystems(time.Second)
+	if received := fake.received(); len(received) != before+1 || received[before] != "vfs.fs.discovery" {
+		t.Fatal("Expected discovery to be queried again after purging, got:", received[before:])
+	}
+}
+
+func TestDiscoveryCacheSharedByAddress(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"vfs.fs.discovery": `{"data":[{"{#FSNAME}":"/","{#FSTYPE}":"ext4"}]}`,
+	})
+
+	// A zero DiscoveryCache doesn't cache but mustn't panic either
+	agent := fake.agent()
+	agent.DiscoveryCache = &DiscoveryCache{}
+	if _, err := agent.DiscoverFilesystems(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Copies of the agent share its entries
+	before := len(fake.received())
+	agent.DiscoveryCache = NewDiscoveryCache(time.Minute)
+	for i := 0; i < 3; i++ {
+		if fs, err := agent.clone().DiscoverFilesystems(time.Second); err != nil || len(fs) != 1 {
+			t.Fatal("Unexpected filesystems:", fs, err)
+		}
+	}
+	if received := fake.received(); len(received) != before+1 {
+		t.Fatal("Expected a single discovery, got:", received[before:])
+	}
+	if n := len(agent.DiscoveryCache.caches); n != 1 {
+		t.Fatal("Expected one entry per address, got:", n)
+	}
+
+	// The cache isn't configuration
+	out, err := json.Marshal(agent)
+	if err != nil || strings.Contains(string(out), "DiscoveryCache") {
+		t.Fatalf("Expected DiscoveryCache to be left out, got: %s (%v)", out, err)
+	}
+}
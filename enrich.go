@@ -0,0 +1,131 @@
+package zagent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// EnrichOptions controls how EnrichHosts queries addresses.
+type EnrichOptions struct {
+	Concurrency int           // Maximum number of hosts in flight. Defaults to 64.
+	Timeout     time.Duration // Timeout for each query. Defaults to 2 seconds.
+
+	// OnResult, if set, is called with each host's result as soon as it's
+	// known, e.g. for progress output. Calls are serialized but not in
+	// address order.
+	OnResult func(HostInfo)
+}
+
+// HostInfo is what EnrichHosts learned about one address.
+type HostInfo struct {
+	Addr string // The address as given to EnrichHosts
+	ScanResult
+}
+
+// Returns true if an agent answered our queries.
+func (h *HostInfo) Reachable() bool {
+	return h.Service == ServiceAgent
+}
+
+/*
+	Returns true if an agent is listening but won't talk to us, because our
+	address isn't in its Server= list or it requires TLS.
+*/
+func (h *HostInfo) Denied() bool {
+	return h.Service == ServiceRejected || h.Service == ServiceTLS
+}
+
+// HostReport is the result of EnrichHosts.
+type HostReport struct {
+	Hosts       []HostInfo // In the order of the addresses
+	Elapsed     time.Duration
+	Reachable   int
+	Denied      int
+	Unreachable int // Neither reachable nor denied, including invalid addresses
+	Skipped     int // Not queried because the context was done first
+}
+
+/*
+	Query agent.hostname and agent.version on every address (host or
+	host:port, see NewAgentFromAddr) concurrently, e.g. to reconcile scan
+	results against an inventory. Hosts are classified like Scan does so
+	agents that refuse us are told apart from unreachable ones. If the
+	context is cancelled the remaining hosts are skipped and the context's
+	error is returned along with the report. Skipped hosts have
+	ServiceUnknown and the context's error, are counted in Skipped rather
+	than Unreachable and aren't passed to OnResult.
+*/
+func EnrichHosts(ctx context.Context, addrs []string, opts EnrichOptions) (*HostReport, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 64
+	}
+	if opts.Timeout < 1 {
+		opts.Timeout = 2 * time.Second
+	}
+
+	start := time.Now()
+	report := &HostReport{Hosts: make([]HostInfo, len(addrs))}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sem := make(chan struct{}, opts.Concurrency)
+
+	skipped := len(addrs) // Index of the first skipped host
+
+loop:
+	for i, addr := range addrs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			skipped = i
+			break loop
+		}
+
+		wg.Add(1)
+		go func(h *HostInfo, addr string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			enrichHost(ctx, h, addr, opts.Timeout)
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case h.Reachable():
+				report.Reachable++
+			case h.Denied():
+				report.Denied++
+			default:
+				report.Unreachable++
+			}
+			if opts.OnResult != nil {
+				opts.OnResult(*h)
+			}
+		}(&report.Hosts[i], addr)
+	}
+	wg.Wait()
+
+	for i := skipped; i < len(addrs); i++ {
+		h := &report.Hosts[i]
+		h.Addr, h.Service, h.Err = addrs[i], ServiceUnknown, ctx.Err()
+	}
+	report.Skipped = len(addrs) - skipped
+
+	report.Elapsed = time.Since(start)
+	return report, ctx.Err()
+}
+
+// Fill in h for the agent at addr.
+func enrichHost(ctx context.Context, h *HostInfo, addr string, timeout time.Duration) {
+	h.Addr = addr
+
+	agent, err := NewAgentFromAddr(addr)
+	if err != nil {
+		h.Service, h.Err = ServiceUnknown, err
+		return
+	}
+
+	h.Host, h.Port = agent.Host, agent.Port
+	fingerprint(ctx, &h.ScanResult, timeout)
+}
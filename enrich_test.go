@@ -0,0 +1,77 @@
+package zagent
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEnrichHosts(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"agent.version":  "6.0.21",
+		"agent.hostname": "db01",
+	})
+	rejecting := newBannerServer(t, "")
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	addrs := []string{agent.ln.Addr().String(), rejecting.Addr().String(), closed.Addr().String(), "[::1"}
+
+	var mu sync.Mutex
+	streamed := 0
+	report, err := EnrichHosts(context.Background(), addrs, EnrichOptions{
+		Timeout: time.Second,
+		OnResult: func(h HostInfo) {
+			mu.Lock()
+			streamed++
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if streamed != len(addrs) {
+		t.Fatal("Expected a callback per address, got:", streamed)
+	}
+	if report.Reachable != 1 || report.Denied != 1 || report.Unreachable != 2 || report.Elapsed <= 0 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+
+	db01 := report.Hosts[0]
+	if db01.Addr != addrs[0] || db01.Hostname != "db01" || db01.Version != "6.0.21" || db01.Err != nil {
+		t.Fatalf("Unexpected host: %+v", db01)
+	}
+
+	if !report.Hosts[1].Denied() || report.Hosts[2].Err == nil || report.Hosts[3].Err == nil {
+		t.Fatalf("Unexpected hosts: %+v", report.Hosts[1:])
+	}
+}
+
+func TestEnrichHostsCancelled(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.version": "6.0.21"})
+	addrs := []string{agent.ln.Addr().String(), agent.ln.Addr().String()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Only one host can start, the other is skipped
+	report, err := EnrichHosts(ctx, addrs, EnrichOptions{Concurrency: 1})
+	if err != context.Canceled {
+		t.Fatal("Expected context.Canceled, got:", err)
+	}
+	if report.Skipped < 1 || report.Reachable+report.Denied+report.Unreachable+report.Skipped != len(addrs) {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+
+	skipped := report.Hosts[len(addrs)-1]
+	if skipped.Addr != addrs[1] || skipped.Service != ServiceUnknown || skipped.Err != context.Canceled {
+		t.Fatalf("Unexpected skipped host: %+v", skipped)
+	}
+}
@@ -0,0 +1,267 @@
+package zagent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAgent is a minimal passive zabbix agent used by the tests. It answers
+// each key with the value registered in items or ZBX_NOTSUPPORTED.
+type fakeAgent struct {
+	ln      net.Listener
+	items   map[string]string
+	respond func(key string) string
+
+	mu      sync.Mutex
+	keys    []string
+	scripts map[string]fakeScript
+}
+
+// fakeScript controls how the fake agent writes the response to a key.
+type fakeScript struct {
+	headerDelay time.Duration // Before writing ZBXD and the flags
+	lengthDelay time.Duration // Before writing the data length
+	bodyDelay   time.Duration // Before writing the data
+	closeAfter  int           // Close after this many bytes of data if > 0
+}
+
+// Start a fake agent listening on addr (e.g. 127.0.0.1:0). It's closed
+// automatically when the test finishes.
+func newFakeAgent(t *testing.T, network, addr string, items map[string]string) *fakeAgent {
+	f := newFakeAgentFunc(t, network, addr, func(key string) string {
+		value, ok := items[key]
+		if !ok {
+			return NotSupported
+		}
+		return value
+	})
+	f.items = items
+
+	return f
+}
+
+// Like newFakeAgent but every value is returned by respond.
+func newFakeAgentFunc(t *testing.T, network, addr string, respond func(key string) string) *fakeAgent {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeAgent{ln: ln, respond: respond}
+	t.Cleanup(func() { ln.Close() })
+	go f.serve()
+
+	return f
+}
+
+// Returns an Agent pointing at the fake agent.
+func (f *fakeAgent) agent() *Agent {
+	host, portS, _ := net.SplitHostPort(f.ln.Addr().String())
+	port, _ := strconv.Atoi(portS)
+	return &Agent{Host: host, Port: port}
+}
+
+// Answer key according to script from now on.
+func (f *fakeAgent) script(key string, script fakeScript) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.scripts == nil {
+		f.scripts = map[string]fakeScript{}
+	}
+	f.scripts[key] = script
+}
+
+// Returns the keys received so far in the order they arrived.
+func (f *fakeAgent) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.keys...)
+}
+
+func (f *fakeAgent) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeAgent) handle(conn net.Conn) {
+	defer conn.Close()
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+	key := string(bytes.TrimRight(buf[:n], "\n"))
+
+	f.mu.Lock()
+	f.keys = append(f.keys, key)
+	script, ok := f.scripts[key]
+	f.mu.Unlock()
+
+	frame := encodeFrame([]byte(f.respond(key)))
+	if !ok {
+		conn.Write(frame)
+		return
+	}
+
+	header, length, body := frame[:5], frame[5:13], frame[13:]
+	if script.closeAfter > 0 && script.closeAfter < len(body) {
+		body = body[:script.closeAfter]
+	}
+
+	for _, part := range []struct {
+		delay time.Duration
+		data  []byte
+	}{{script.headerDelay, header}, {script.lengthDelay, length}, {script.bodyDelay, body}} {
+		time.Sleep(part.delay)
+		if _, err := conn.Write(part.data); err != nil {
+			return
+		}
+	}
+}
+
+// Wrap data in a ZBXD\x01 header followed by the little endian data length.
+func encodeFrame(data []byte) []byte {
+	frame := make([]byte, 13, 13+len(data))
+	copy(frame, "ZBXD\x01")
+	binary.LittleEndian.PutUint64(frame[5:], uint64(len(data)))
+	return append(frame, data...)
+}
+
+// Start a server that hands every connection to handle and then closes it.
+func newRawServer(t *testing.T, handle func(conn net.Conn)) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+
+	return ln
+}
+
+// Like newRawServer but connections are handled one at a time, the next
+// isn't accepted until the last is closed.
+func newSerialServer(t *testing.T, handle func(conn net.Conn)) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			handle(conn)
+			conn.Close()
+		}
+	}()
+
+	return ln
+}
+
+// Returns an Agent pointing at the listener.
+func agentFor(ln net.Listener) *Agent {
+	return (&fakeAgent{ln: ln}).agent()
+}
+
+func TestFakeAgentScripts(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"slow.header": "1",
+		"slow.body":   "1",
+		"truncated":   "some data to truncate",
+	})
+	fake.script("slow.header", fakeScript{headerDelay: 300 * time.Millisecond})
+	fake.script("slow.body", fakeScript{lengthDelay: 60 * time.Millisecond, bodyDelay: 300 * time.Millisecond})
+	fake.script("truncated", fakeScript{bodyDelay: 10 * time.Millisecond, closeAfter: 5})
+
+	// The overall deadline
+	agent := fake.agent()
+	if _, err := agent.Query("slow.header", 100*time.Millisecond); !isTimeout(err) || err == ErrIdleTimeout {
+		t.Error("Expected the overall timeout, got:", err)
+	}
+
+	// Nothing arriving for IdleTimeout, before or part way through the response
+	agent.IdleTimeout = 100 * time.Millisecond
+	for _, key := range []string{"slow.header", "slow.body"} {
+		if _, err := agent.Query(key, 5*time.Second); err != ErrIdleTimeout {
+			t.Errorf("%s: expected ErrIdleTimeout, got: %v", key, err)
+		}
+	}
+
+	// Each delay is attributed to the right phase
+	agent.IdleTimeout = 0
+	res, err := agent.Query("slow.body", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm := res.Timings; tm.TimeToFirstByte > 50*time.Millisecond || tm.Read < 360*time.Millisecond {
+		t.Errorf("Unexpected timings: %+v", tm)
+	}
+	res, err = agent.Query("slow.header", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm := res.Timings; tm.TimeToFirstByte < 300*time.Millisecond || tm.Read > 50*time.Millisecond {
+		t.Errorf("Unexpected timings: %+v", tm)
+	}
+
+	// Closing part way through the data
+	if _, err := agent.Query("truncated", time.Second); err != ErrTruncatedResponse {
+		t.Error("Expected ErrTruncatedResponse, got:", err)
+	}
+	res, err = agent.QueryContext(WithPartial(context.Background()), "truncated")
+	if err != ErrTruncatedResponse || res == nil || res.String() != "some " || !res.Partial {
+		t.Errorf("Expected the first 5 bytes as a partial response, got: %+v (%v)", res, err)
+	}
+}
+
+// Run f and fail the test if it hasn't returned within d, e.g. deadlocked.
+func within(t *testing.T, d time.Duration, f func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatal("Still running after", d)
+	}
+}
+
+// Returns true if err is a network timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,275 @@
+package zagent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// Frame flags, see https://www.zabbix.com/documentation/current/en/manual/appendix/protocols/header_datalen
+const (
+	FlagProtocol   byte = 0x01 // Always set
+	FlagCompressed byte = 0x02 // Data is zlib compressed
+	FlagLarge      byte = 0x04 // Lengths are 8 bytes each instead of 4
+)
+
+var (
+	// The frame's flags don't include FlagProtocol or have unknown bits set.
+	ErrInvalidFlags = errors.New("invalid frame flags")
+
+	// The frame's data is larger than the maximum allowed size.
+	ErrFrameTooLarge = errors.New("frame too large")
+
+	// The reserved length field of an uncompressed frame isn't zero or a
+	// length doesn't fit the frame's layout.
+	ErrInvalidLength = errors.New("invalid frame length")
+
+	// The compressed data couldn't be decompressed or its size didn't
+	// match the frame's header.
+	ErrInvalidCompression = errors.New("invalid compressed data")
+
+	// The compressed data is neither a zlib nor a gzip stream.
+	ErrUnknownCompression = errors.New("unknown compression format")
+)
+
+/*
+	Frame is a single message in the zabbix protocol. On the wire it's
+	"ZBXD", the flags, the data length and reserved fields (4 bytes each, or
+	8 with FlagLarge) followed by the data. For compressed frames the
+	reserved field holds the uncompressed size. Data is always uncompressed.
+
+	Zabbix only sets FlagLarge when a length doesn't fit in 4 bytes. That's
+	bulk server and proxy traffic rather than agent replies, which are
+	limited far below 4 GiB, but any frame may use it.
+*/
+type Frame struct {
+	Flags byte
+	Data  []byte
+}
+
+// Header is the 5 byte header that starts every frame.
+type Header struct {
+	Magic [4]byte // Always ZBXD
+	Flags byte
+}
+
+/*
+	Parse and validate the first 5 bytes of b as a frame header. Returns
+	ErrTruncatedResponse if b is too short, ErrInvalidHeader if the magic
+	isn't ZBXD and ErrInvalidFlags for unknown flags.
+*/
+func ParseHeader(b []byte) (Header, error) {
+	h := Header{}
+	if len(b) < 5 {
+		return h, ErrTruncatedResponse
+	}
+
+	copy(h.Magic[:], b)
+	h.Flags = b[4]
+
+	if string(h.Magic[:]) != "ZBXD" {
+		return h, ErrInvalidHeader
+	}
+
+	return h, checkFlags(h.Flags)
+}
+
+// Write f to w, compressing the data if f.Flags has FlagCompressed.
+func WriteFrame(w io.Writer, f Frame) error {
+	if err := checkFlags(f.Flags); err != nil {
+		return err
+	}
+
+	data, reserved := f.Data, uint64(0)
+	if f.Flags&FlagCompressed != 0 {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(f.Data)
+		zw.Close()
+
+		data, reserved = buf.Bytes(), uint64(len(f.Data))
+	}
+
+	var header []byte
+	if f.Flags&FlagLarge != 0 {
+		header = make([]byte, 21)
+		binary.LittleEndian.PutUint64(header[5:], uint64(len(data)))
+		binary.LittleEndian.PutUint64(header[13:], reserved)
+	} else {
+		if uint64(len(data)) > math.MaxUint32 || reserved > math.MaxUint32 {
+			return ErrFrameTooLarge
+		}
+		header = make([]byte, 13)
+		binary.LittleEndian.PutUint32(header[5:], uint32(len(data)))
+		binary.LittleEndian.PutUint32(header[9:], uint32(reserved))
+	}
+	copy(header, "ZBXD")
+	header[4] = f.Flags
+
+	_, err := w.Write(append(header, data...))
+	return err
+}
+
+/*
+	Read a single frame from r. Frames whose data (compressed or not) is
+	larger than maxSize are rejected with ErrFrameTooLarge before reading
+	the data, a maxSize of 0 means no limit. io.EOF is returned if r ends
+	before the first byte, ErrTruncatedResponse if it ends part way through.
+*/
+func ReadFrame(r io.Reader, maxSize uint64) (Frame, error) {
+	f, _, err := readFrame(r, maxSize, nil, nil)
+	if err != nil {
+		f.Data = nil
+	}
+	return f, err
+}
+
+/*
+	Read a frame, reporting the progress of reading the data to p if not
+	nil. If reserve isn't nil it's called with the memory the data will
+	take before reading it and an error aborts the read. If reading the
+	data of an uncompressed frame fails f.Data holds the data received so
+	far and dataLen the length declared by the frame.
+*/
+func readFrame(r io.Reader, maxSize uint64, p *progress, reserve func(size uint64) error) (f Frame, dataLen uint64, err error) {
+	header := make([]byte, 5)
+
+	n, err := io.ReadFull(r, header)
+	if n == 0 {
+		// Let the caller decide what a connection that ends straight away means
+		return f, 0, err
+	}
+
+	magic := min(n, 4)
+	if string(header[:magic]) != "ZBXD"[:magic] {
+		return f, 0, ErrInvalidHeader
+	}
+	if err != nil {
+		return f, 0, readError(err)
+	}
+
+	h, err := ParseHeader(header)
+	if err != nil {
+		return f, 0, err
+	}
+	f.Flags = h.Flags
+
+	lengths := make([]byte, 8)
+	if f.Flags&FlagLarge != 0 {
+		lengths = make([]byte, 16)
+	}
+	if _, err := io.ReadFull(r, lengths); err != nil {
+		return f, 0, readError(err)
+	}
+
+	var reserved uint64
+	if f.Flags&FlagLarge != 0 {
+		dataLen = binary.LittleEndian.Uint64(lengths)
+		reserved = binary.LittleEndian.Uint64(lengths[8:])
+	} else {
+		dataLen = uint64(binary.LittleEndian.Uint32(lengths))
+		reserved = uint64(binary.LittleEndian.Uint32(lengths[4:]))
+	}
+
+	compressed := f.Flags&FlagCompressed != 0
+	switch {
+	case dataLen > math.MaxInt64 || reserved > math.MaxInt64:
+		return f, 0, ErrInvalidLength
+	case !compressed && reserved != 0:
+		return f, 0, ErrInvalidLength
+	case maxSize > 0 && (dataLen > maxSize || reserved > maxSize):
+		return f, 0, ErrFrameTooLarge
+	}
+
+	if reserve != nil {
+		size := dataLen
+		if compressed {
+			size += reserved
+		}
+		if err := reserve(size); err != nil {
+			return f, 0, err
+		}
+	}
+
+	var body io.Reader = io.LimitReader(r, int64(dataLen))
+	if p != nil {
+		body = &progressReader{r: body, p: p, total: dataLen}
+	}
+
+	// Grow the buffer as data arrives rather than trusting dataLen
+	data, err := ioutil.ReadAll(body)
+	if err == nil && uint64(len(data)) < dataLen {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		if !compressed {
+			f.Data = data
+		}
+		return f, dataLen, readError(err)
+	}
+
+	if compressed {
+		if data, err = decompress(data, reserved); err != nil {
+			return f, 0, err
+		}
+	}
+	f.Data = data
+
+	return f, dataLen, nil
+}
+
+// Returns ErrInvalidFlags unless flags has FlagProtocol and no unknown bits set.
+func checkFlags(flags byte) error {
+	if flags&FlagProtocol == 0 || flags&^(FlagProtocol|FlagCompressed|FlagLarge) != 0 {
+		return fmt.Errorf("%w: %#x", ErrInvalidFlags, flags)
+	}
+	return nil
+}
+
+/*
+	Inflate compressed data which must be exactly size bytes uncompressed.
+	Agents send zlib but some proxies use gzip, the format is detected from
+	the stream's header bytes.
+*/
+func decompress(data []byte, size uint64) ([]byte, error) {
+	var zr io.Reader
+	var err error
+	switch {
+	case isZlib(data):
+		zr, err = zlib.NewReader(bytes.NewReader(data))
+	case isGzip(data):
+		zr, err = gzip.NewReader(bytes.NewReader(data))
+	default:
+		return nil, ErrUnknownCompression
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCompression, err)
+	}
+
+	// Read one byte more than expected to detect oversized data
+	out, err := ioutil.ReadAll(io.LimitReader(zr, int64(size)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCompression, err)
+	}
+	if uint64(len(out)) != size {
+		return nil, fmt.Errorf("%w: expected %d bytes, got %d", ErrInvalidCompression, size, len(out))
+	}
+
+	return out, nil
+}
+
+// Returns true if data starts with a zlib header using deflate.
+func isZlib(data []byte) bool {
+	return len(data) >= 2 && data[0]&0x0f == 8 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0
+}
+
+// Returns true if data starts with the gzip magic.
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
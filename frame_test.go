@@ -0,0 +1,217 @@
+package zagent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+var frameFlags = []byte{
+	FlagProtocol,
+	FlagProtocol | FlagCompressed,
+	FlagProtocol | FlagLarge,
+	FlagProtocol | FlagCompressed | FlagLarge,
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	payloads := [][]byte{nil, []byte("1"), bytes.Repeat([]byte("zabbix\x00"), 10000)}
+
+	for _, flags := range frameFlags {
+		for _, data := range payloads {
+			var buf bytes.Buffer
+			if err := WriteFrame(&buf, Frame{Flags: flags, Data: data}); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := ReadFrame(&buf, 0)
+			if err != nil {
+				t.Fatalf("flags %#x: %v", flags, err)
+			}
+
+			if f.Flags != flags || !bytes.Equal(f.Data, data) {
+				t.Fatalf("flags %#x: frame didn't round trip", flags)
+			}
+
+			if buf.Len() != 0 {
+				t.Fatalf("flags %#x: %d bytes left unread", flags, buf.Len())
+			}
+		}
+	}
+}
+
+func TestFrameWireFormat(t *testing.T) {
+	var buf bytes.Buffer
+	WriteFrame(&buf, Frame{Flags: FlagProtocol, Data: []byte("1")})
+
+	if want := "ZBXD\x01\x01\x00\x00\x00\x00\x00\x00\x001"; buf.String() != want {
+		t.Fatalf("Expected %q, got %q", want, buf.String())
+	}
+
+	buf.Reset()
+	WriteFrame(&buf, Frame{Flags: FlagProtocol | FlagLarge, Data: []byte("1")})
+	if buf.Len() != 22 {
+		t.Fatal("Large frames should have a 21 byte header, got", buf.Len()-1)
+	}
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	for _, flags := range frameFlags {
+		var buf bytes.Buffer
+		WriteFrame(&buf, Frame{Flags: flags, Data: []byte("some data to truncate")})
+		frame := buf.Bytes()
+
+		if _, err := ReadFrame(bytes.NewReader(nil), 0); err != io.EOF {
+			t.Fatal("Expected io.EOF for an empty reader, got:", err)
+		}
+
+		for i := 1; i < len(frame); i++ {
+			_, err := ReadFrame(bytes.NewReader(frame[:i]), 0)
+			if err != ErrTruncatedResponse {
+				t.Fatalf("flags %#x truncated at %d: expected ErrTruncatedResponse, got %v", flags, i, err)
+			}
+		}
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	var compressed bytes.Buffer
+	WriteFrame(&compressed, Frame{Flags: FlagProtocol | FlagCompressed, Data: []byte("data")})
+	corrupt := append([]byte(nil), compressed.Bytes()...)
+	corrupt[len(corrupt)-3] ^= 0xff
+	wrongSize := append([]byte(nil), compressed.Bytes()...)
+	wrongSize[9] = 10
+
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"magic", []byte("HTTP/1.1 400"), ErrInvalidHeader},
+		{"short magic", []byte("ZX"), ErrInvalidHeader},
+		{"no protocol flag", []byte("ZBXD\x00\x00\x00\x00\x00\x00\x00\x00\x00"), ErrInvalidFlags},
+		{"unknown flag", []byte("ZBXD\x09\x00\x00\x00\x00\x00\x00\x00\x00"), ErrInvalidFlags},
+		{"reserved", []byte("ZBXD\x01\x01\x00\x00\x00\x01\x00\x00\x00x"), ErrInvalidLength},
+		{"too large", []byte("ZBXD\x01\x00\x00\x00\x01\x00\x00\x00\x00"), ErrFrameTooLarge},
+		{"large overflow", []byte("ZBXD\x05\xff\xff\xff\xff\xff\xff\xff\xff\x00\x00\x00\x00\x00\x00\x00\x00"), ErrInvalidLength},
+		{"corrupt", corrupt, ErrInvalidCompression},
+		{"wrong size", wrongSize, ErrInvalidCompression},
+	}
+
+	for _, test := range tests {
+		_, err := ReadFrame(bytes.NewReader(test.frame), 1<<20)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestReadFrameCompressionFormats(t *testing.T) {
+	data := []byte("compressed by a proxy")
+
+	var zbuf, gbuf bytes.Buffer
+	zw := zlib.NewWriter(&zbuf)
+	zw.Write(data)
+	zw.Close()
+	gw := gzip.NewWriter(&gbuf)
+	gw.Write(data)
+	gw.Close()
+
+	corrupt := append([]byte(nil), zbuf.Bytes()...)
+	corrupt[0], corrupt[1] = 0x00, 0x00
+
+	tests := []struct {
+		name    string
+		payload []byte
+		err     error
+	}{
+		{"zlib", zbuf.Bytes(), nil},
+		{"gzip", gbuf.Bytes(), nil},
+		{"corrupt header", corrupt, ErrUnknownCompression},
+		{"empty", nil, ErrUnknownCompression},
+	}
+
+	for _, test := range tests {
+		frame := []byte("ZBXD\x03")
+		frame = binary.LittleEndian.AppendUint32(frame, uint32(len(test.payload)))
+		frame = binary.LittleEndian.AppendUint32(frame, uint32(len(data)))
+		frame = append(frame, test.payload...)
+
+		f, err := ReadFrame(bytes.NewReader(frame), 0)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+			continue
+		}
+		if err == nil && !bytes.Equal(f.Data, data) {
+			t.Errorf("%s: unexpected data %q", test.name, f.Data)
+		}
+	}
+}
+
+func TestWriteFrameInvalidFlags(t *testing.T) {
+	if err := WriteFrame(io.Discard, Frame{Flags: 0x10}); !errors.Is(err, ErrInvalidFlags) {
+		t.Fatal("Expected ErrInvalidFlags, got:", err)
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	for _, flags := range frameFlags {
+		var buf bytes.Buffer
+		WriteFrame(&buf, Frame{Flags: flags, Data: []byte("ZBX_NOTSUPPORTED\x00Unsupported item key.")})
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte("ZBXD\x01\xff\xff\xff\xff\x00\x00\x00\x00"))
+	f.Add([]byte("ZBXD\x07\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xff\xff\xff\xff\xff\x7f"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		frame, err := ReadFrame(bytes.NewReader(b), 1<<20)
+		if err != nil {
+			return
+		}
+
+		// Anything we can read we must be able to write and read back
+		var buf bytes.Buffer
+		if err := WriteFrame(&buf, frame); err != nil {
+			t.Fatal(err)
+		}
+
+		again, err := ReadFrame(&buf, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if again.Flags != frame.Flags || !bytes.Equal(again.Data, frame.Data) {
+			t.Fatal("Frame didn't round trip")
+		}
+	})
+}
+
+func TestParseHeader(t *testing.T) {
+	h, err := ParseHeader([]byte("ZBXD\x03\x10\x00\x00\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(h.Magic[:]) != "ZBXD" || h.Flags != FlagProtocol|FlagCompressed {
+		t.Fatalf("Unexpected header: %+v", h)
+	}
+
+	tests := []struct {
+		header string
+		err    error
+	}{
+		{"ZBXD", ErrTruncatedResponse},
+		{"ZBXE\x01", ErrInvalidHeader},
+		{"ZBXD\x00", ErrInvalidFlags},
+		{"ZBXD\x81", ErrInvalidFlags},
+	}
+
+	for _, test := range tests {
+		if _, err := ParseHeader([]byte(test.header)); !errors.Is(err, test.err) {
+			t.Errorf("%q: expected %v, got %v", test.header, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package zagent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+)
+
+/*
+	FramingMode is how keys are sent to the agent.
+
+	FramingPlain sends the bare key. Every agent version accepts it and it's
+	the cheapest, but nothing tells the agent where the key ends other than
+	the packet boundary.
+
+	FramingZBXD wraps the key in a ZBXD frame like the zabbix server does
+	since 4.0, so the agent reads exactly the key's length.
+
+	FramingZBXDJSON sends a 7.0 style JSON passive check request in a ZBXD
+	frame. The agent replies with JSON which is unwrapped so Response.Data
+	holds the value as usual and errors become ZBX_NOTSUPPORTED with the
+	agent's message as the reason. Agents before 7.0 don't understand it.
+
+	FramingAuto queries agent.version once with FramingPlain and picks the
+	newest framing the agent supports, caching the choice on the Agent.
+*/
+type FramingMode int
+
+const (
+	FramingPlain FramingMode = iota
+	FramingZBXD
+	FramingZBXDJSON
+	FramingAuto
+)
+
+func (m FramingMode) String() string {
+	switch m {
+	case FramingPlain:
+		return "plain"
+	case FramingZBXD:
+		return "zbxd"
+	case FramingZBXDJSON:
+		return "zbxd-json"
+	}
+	return "auto"
+}
+
+// Returns the framing to use, probing the agent once for FramingAuto.
+func (a *Agent) framing(ctx context.Context) (FramingMode, error) {
+	if a.Framing != FramingAuto {
+		return a.Framing, nil
+	}
+
+	a.mu.Lock()
+	mode, known := a.framingMode, a.framingKnown
+	a.mu.Unlock()
+	if known {
+		return mode, nil
+	}
+
+	probe := a.clone()
+	// The probe is internal so AllowedKeys doesn't apply to it
+	probe.Framing, probe.AllowedKeys = FramingPlain, nil
+	res, err := probe.QueryContext(ctx, "agent.version")
+	if err != nil {
+		return FramingPlain, err
+	}
+
+	mode = FramingPlain
+	if major, _, ok := majorMinor(res.String()); ok && major >= 7 {
+		mode = FramingZBXDJSON
+	} else if ok && major >= 4 {
+		mode = FramingZBXD
+	}
+
+	a.mu.Lock()
+	a.framingMode, a.framingKnown = mode, true
+	a.mu.Unlock()
+
+	return mode, nil
+}
+
+// Write the request for key framed as mode.
+func writeRequest(w io.Writer, key string, mode FramingMode) error {
+	switch mode {
+	case FramingZBXD:
+		return WriteFrame(w, Frame{Flags: FlagProtocol, Data: []byte(key)})
+	case FramingZBXDJSON:
+		request := map[string]interface{}{
+			"request": "passive checks",
+			"data":    []map[string]string{{"key": key}},
+		}
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		return WriteFrame(w, Frame{Flags: FlagProtocol, Data: data})
+	}
+
+	_, err := io.WriteString(w, key)
+	return err
+}
+
+/*
+	Replace the JSON passive check reply in res with its value, or with
+	ZBX_NOTSUPPORTED and the agent's error. Replies that aren't JSON are
+	left alone.
+*/
+func unwrapJSONReply(res *Response) {
+	var reply struct {
+		Data []struct {
+			Value *string `json:"value"`
+			Error *string `json:"error"`
+		} `json:"data"`
+		Error *string `json:"error"`
+	}
+
+	if !bytes.HasPrefix(res.Data, []byte("{")) || json.Unmarshal(res.Data, &reply) != nil {
+		return
+	}
+
+	switch {
+	case reply.Error != nil:
+		res.Data = []byte(NotSupported + "\x00" + *reply.Error)
+	case len(reply.Data) == 0:
+		return
+	case reply.Data[0].Error != nil:
+		res.Data = []byte(NotSupported + "\x00" + *reply.Data[0].Error)
+	case reply.Data[0].Value != nil:
+		res.Data = []byte(*reply.Data[0].Value)
+	default:
+		return
+	}
+	res.DataLength = uint64(len(res.Data))
+}
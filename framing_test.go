@@ -0,0 +1,188 @@
+package zagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Start an agent of the given version that answers plain, ZBXD and JSON
+// requests, recording how each request was framed.
+func newFramingServer(t *testing.T, version string) (*Agent, func() []FramingMode) {
+	return framingServer(t, version, newRawServer)
+}
+
+// Like newFramingServer but started with serve, e.g. newSerialServer.
+func framingServer(t *testing.T, version string, serve func(*testing.T, func(net.Conn)) net.Listener) (*Agent, func() []FramingMode) {
+	var mu sync.Mutex
+	var modes []FramingMode
+
+	ln := serve(t, func(conn net.Conn) {
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		mode, key := FramingPlain, string(buf[:n])
+		if f, err := ReadFrame(bytes.NewReader(buf[:n]), 0); err == nil {
+			mode, key = FramingZBXD, string(f.Data)
+
+			var request struct {
+				Data []struct{ Key string }
+			}
+			if json.Unmarshal(f.Data, &request) == nil {
+				mode, key = FramingZBXDJSON, request.Data[0].Key
+			}
+		}
+
+		mu.Lock()
+		modes = append(modes, mode)
+		mu.Unlock()
+
+		value := NotSupported
+		switch key {
+		case "agent.version":
+			value = version
+		case "agent.hostname":
+			value = "web01"
+		}
+		if mode == FramingZBXDJSON {
+			reply := `{"version":"` + version + `","variant":2,"data":[{"value":"` + value + `"}]}`
+			if value == NotSupported {
+				reply = `{"version":"` + version + `","variant":2,"data":[{"error":"Unknown metric ` + key + `"}]}`
+			}
+			value = reply
+		}
+		conn.Write(encodeFrame([]byte(value)))
+	})
+
+	return agentFor(ln), func() []FramingMode {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]FramingMode(nil), modes...)
+	}
+}
+
+func TestFramingModes(t *testing.T) {
+	for _, mode := range []FramingMode{FramingPlain, FramingZBXD, FramingZBXDJSON} {
+		agent, received := newFramingServer(t, "7.0.3")
+		agent.Framing = mode
+
+		res, err := agent.Query("agent.version", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.String() != "7.0.3" {
+			t.Errorf("%v: unexpected value %q", mode, res.String())
+		}
+
+		res, err = agent.Query("missing.key", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Supported() {
+			t.Errorf("%v: expected missing.key to be unsupported, got %q", mode, res.String())
+		}
+		if mode == FramingZBXDJSON && !strings.HasSuffix(res.String(), "\x00Unknown metric missing.key") {
+			t.Errorf("%v: expected the agent's error as the reason, got %q", mode, res.String())
+		}
+
+		if modes := received(); len(modes) != 2 || modes[0] != mode || modes[1] != mode {
+			t.Errorf("%v: requests were framed as %v", mode, modes)
+		}
+	}
+}
+
+func TestFramingAuto(t *testing.T) {
+	tests := []struct {
+		version string
+		want    FramingMode
+	}{
+		{"3.0.32", FramingPlain},
+		{"6.0.21", FramingZBXD},
+		{"7.0.3", FramingZBXDJSON},
+	}
+
+	for _, test := range tests {
+		agent, received := newFramingServer(t, test.version)
+		agent.Framing = FramingAuto
+
+		for i := 0; i < 2; i++ {
+			if _, err := agent.Query("agent.ping", time.Second); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// A single plain probe and then the chosen framing
+		want := []FramingMode{FramingPlain, test.want, test.want}
+		modes := received()
+		if len(modes) != len(want) || modes[0] != want[0] || modes[1] != want[1] || modes[2] != want[2] {
+			t.Errorf("%s: expected %v, got %v", test.version, want, modes)
+		}
+	}
+}
+
+func TestFramingAutoWithHostname(t *testing.T) {
+	agent, received := newFramingServer(t, "7.0.3")
+	agent.Framing = FramingAuto
+	agent.ExpectedHostname = "web01"
+
+	// The hostname check chooses the framing while it's being checked
+	within(t, 5*time.Second, func() {
+		for i := 0; i < 2; i++ {
+			if _, err := agent.Query("agent.ping", time.Second); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	if modes := received(); len(modes) == 0 || modes[len(modes)-1] != FramingZBXDJSON {
+		t.Error("Expected the chosen framing to be used, got:", modes)
+	}
+}
+
+func TestFramingAutoOneConnection(t *testing.T) {
+	// Like zabbix_agentd with StartAgents=1
+	agent, received := framingServer(t, "6.0.21", newSerialServer)
+	agent.Framing = FramingAuto
+
+	if _, err := agent.Query("agent.ping", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := agent.Dial(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if _, err := session.Query("agent.ping", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []FramingMode{FramingPlain, FramingZBXD, FramingZBXD}
+	if modes := received(); !reflect.DeepEqual(modes, want) {
+		t.Fatalf("Expected %v, got %v", want, modes)
+	}
+
+	// A session chooses the framing before dialing too
+	agent, received = framingServer(t, "7.0.3", newSerialServer)
+	agent.Framing = FramingAuto
+	if session, err = agent.Dial(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if _, err := session.Query("agent.ping", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if want := []FramingMode{FramingPlain, FramingZBXDJSON}; !reflect.DeepEqual(received(), want) {
+		t.Fatalf("Expected %v, got %v", want, received())
+	}
+}
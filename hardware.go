@@ -0,0 +1,75 @@
+package zagent
+
+import (
+	"strings"
+	"time"
+)
+
+/*
+	HWInventory is the hardware reported by an agent's system.hw.* keys.
+	Several of them need root or tools such as lspci on the agent's host
+	so agents often don't support them all, Unsupported lists those keys.
+*/
+type HWInventory struct {
+	ChassisVendor string   // system.hw.chassis[vendor]
+	ChassisModel  string   // system.hw.chassis[model]
+	ChassisSerial string   // system.hw.chassis[serial]
+	ChassisType   string   // system.hw.chassis[type]
+	CPUs          []string // system.hw.cpu[all,full], one line per CPU
+	PCIDevices    []string // system.hw.devices[pci], one line per device
+	USBDevices    []string // system.hw.devices[usb], one line per device
+	MACAddresses  string   // system.hw.macaddr, e.g. [eth0] 52:54:00:12:34:56
+	Unsupported   []string // Keys the agent didn't support
+}
+
+/*
+	Query the agent's hardware inventory keys over a single Session, so
+	agents that keep connections open are only dialed once. Unsupported
+	keys leave their fields empty and are listed in Unsupported. Any other
+	error stops the inventory and is returned with what was collected.
+*/
+func (a *Agent) HardwareInventory(timeout time.Duration) (HWInventory, error) {
+	var inv HWInventory
+
+	fields := []struct {
+		key   string
+		value *string
+		lines *[]string
+	}{
+		{key: "system.hw.chassis[vendor]", value: &inv.ChassisVendor},
+		{key: "system.hw.chassis[model]", value: &inv.ChassisModel},
+		{key: "system.hw.chassis[serial]", value: &inv.ChassisSerial},
+		{key: "system.hw.chassis[type]", value: &inv.ChassisType},
+		{key: "system.hw.cpu[all,full]", lines: &inv.CPUs},
+		{key: "system.hw.devices[pci]", lines: &inv.PCIDevices},
+		{key: "system.hw.devices[usb]", lines: &inv.USBDevices},
+		{key: "system.hw.macaddr", value: &inv.MACAddresses},
+	}
+
+	session, err := a.Dial(timeout)
+	if err != nil {
+		return inv, err
+	}
+	defer session.Close()
+
+	for _, field := range fields {
+		res, err := session.Query(field.key, timeout)
+		if err != nil {
+			return inv, err
+		}
+
+		if !res.Supported() {
+			inv.Unsupported = append(inv.Unsupported, field.key)
+			continue
+		}
+
+		value := strings.TrimSpace(res.String())
+		if field.value != nil {
+			*field.value = value
+		} else if value != "" {
+			*field.lines = strings.Split(value, "\n")
+		}
+	}
+
+	return inv, nil
+}
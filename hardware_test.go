@@ -0,0 +1,38 @@
+package zagent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHardwareInventory(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"system.hw.chassis[vendor]": "Dell Inc.",
+		"system.hw.chassis[model]":  "PowerEdge R640",
+		"system.hw.chassis[serial]": "ABC1234",
+		"system.hw.chassis[type]":   "Rack Mount Chassis",
+		"system.hw.cpu[all,full]":   "cpu0 Intel Xeon 2400MHz\ncpu1 Intel Xeon 2400MHz\n",
+		"system.hw.devices[pci]":    "00:00.0 Host bridge\n00:1f.2 SATA controller",
+		"system.hw.macaddr":         "[eno1] 52:54:00:12:34:56",
+	}).agent()
+
+	inv, err := agent.HardwareInventory(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := HWInventory{
+		ChassisVendor: "Dell Inc.",
+		ChassisModel:  "PowerEdge R640",
+		ChassisSerial: "ABC1234",
+		ChassisType:   "Rack Mount Chassis",
+		CPUs:          []string{"cpu0 Intel Xeon 2400MHz", "cpu1 Intel Xeon 2400MHz"},
+		PCIDevices:    []string{"00:00.0 Host bridge", "00:1f.2 SATA controller"},
+		MACAddresses:  "[eno1] 52:54:00:12:34:56",
+		Unsupported:   []string{"system.hw.devices[usb]"},
+	}
+	if !reflect.DeepEqual(inv, want) {
+		t.Fatalf("Expected %+v, got %+v", want, inv)
+	}
+}
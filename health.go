@@ -0,0 +1,51 @@
+package zagent
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Returned by HealthScore when there's nothing to weigh.
+var ErrNoWeight = errors.New("checks have no weight")
+
+// WeightedCheck is one check contributing to a HealthScore.
+type WeightedCheck struct {
+	Response *Response // nil if the query failed, which counts as failing
+	Weight   float64
+
+	// OKFunc returns true if the response passes. If nil a response passes
+	// if the key was supported.
+	OKFunc func(*Response) bool
+}
+
+/*
+	Returns the weighted percentage (0 to 100) of checks that pass. Weights
+	must not be negative and at least one must be positive.
+*/
+func HealthScore(checks []WeightedCheck) (float64, error) {
+	var total, passing float64
+	for i, check := range checks {
+		if check.Weight < 0 {
+			return 0, fmt.Errorf("check %d has negative weight %v", i, check.Weight)
+		}
+		total += check.Weight
+
+		if check.Response == nil {
+			continue
+		}
+
+		ok := check.Response.Supported()
+		if check.OKFunc != nil {
+			ok = check.OKFunc(check.Response)
+		}
+		if ok {
+			passing += check.Weight
+		}
+	}
+
+	if total == 0 {
+		return 0, ErrNoWeight
+	}
+
+	return 100 * passing / total, nil
+}
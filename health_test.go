@@ -0,0 +1,38 @@
+package zagent
+
+import "testing"
+
+func TestHealthScore(t *testing.T) {
+	pingOK := func(r *Response) bool {
+		ok, err := r.Bool()
+		return err == nil && ok
+	}
+	below90 := func(r *Response) bool {
+		v, err := r.Float64()
+		return err == nil && v < 90
+	}
+
+	score, err := HealthScore([]WeightedCheck{
+		{Response: &Response{Data: []byte("1")}, Weight: 5, OKFunc: pingOK},
+		{Response: &Response{Data: []byte("97.5")}, Weight: 3, OKFunc: below90},
+		{Response: &Response{Data: []byte("Linux")}, Weight: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score != 70 {
+		t.Fatal("Expected a score of 70, got:", score)
+	}
+
+	score, err = HealthScore([]WeightedCheck{{Response: nil, Weight: 1}, {Response: &Response{Data: []byte(NotSupported)}, Weight: 1}})
+	if err != nil || score != 0 {
+		t.Fatal("Expected a score of 0, got:", score, err)
+	}
+
+	if _, err := HealthScore(nil); err != ErrNoWeight {
+		t.Fatal("Expected ErrNoWeight, got:", err)
+	}
+	if _, err := HealthScore([]WeightedCheck{{Weight: -1}}); err == nil {
+		t.Fatal("Expected an error for a negative weight")
+	}
+}
@@ -0,0 +1,78 @@
+package zagent
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrHostnameMismatch matches any *HostnameMismatchError with errors.Is.
+var ErrHostnameMismatch = errors.New("agent hostname mismatch")
+
+// HostnameMismatchError is returned when agent.hostname doesn't match Agent.ExpectedHostname.
+type HostnameMismatchError struct {
+	Expected string
+	Got      string
+}
+
+func (e *HostnameMismatchError) Error() string {
+	return "expected agent hostname " + e.Expected + " but got " + e.Got
+}
+
+func (e *HostnameMismatchError) Is(target error) bool {
+	return target == ErrHostnameMismatch
+}
+
+/*
+	Compare agent.hostname, fetched with query, to ExpectedHostname unless
+	a recent enough result is cached. Network errors aren't cached. Only
+	one check runs at a time, queries arriving meanwhile wait for its
+	result. a.mu isn't held while querying since the query needs it.
+*/
+func (a *Agent) verifyHostname(query func() (*Response, error)) error {
+	if a.ExpectedHostname == "" {
+		return nil
+	}
+
+	a.hostnameCheck.Lock()
+	defer a.hostnameCheck.Unlock()
+
+	if ok, err := a.cachedHostname(); ok {
+		return err
+	}
+
+	res, err := query()
+	if err != nil {
+		return err
+	}
+
+	normalize := a.NormalizeHostname
+	if normalize == nil {
+		normalize = strings.TrimSpace
+	}
+
+	var mismatch error
+	if !strings.EqualFold(normalize(res.String()), normalize(a.ExpectedHostname)) {
+		mismatch = &HostnameMismatchError{Expected: a.ExpectedHostname, Got: res.String()}
+	}
+
+	a.mu.Lock()
+	a.hostnameErr, a.hostnameTime = mismatch, time.Now()
+	a.mu.Unlock()
+
+	return mismatch
+}
+
+// Returns whether the cached hostname check is still valid and its result.
+func (a *Agent) cachedHostname() (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.hostnameTime.IsZero() {
+		return false, nil
+	}
+	if a.HostnameCheckInterval < 1 {
+		return a.hostnameErr == nil, nil
+	}
+	return time.Since(a.hostnameTime) < a.HostnameCheckInterval, a.hostnameErr
+}
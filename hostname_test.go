@@ -0,0 +1,67 @@
+package zagent
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpectedHostname(t *testing.T) {
+	items := map[string]string{"agent.hostname": "Web01.example.com", "agent.ping": "1"}
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", items)
+
+	agent := fake.agent()
+	agent.ExpectedHostname = "web01"
+	agent.NormalizeHostname = func(s string) string {
+		return strings.SplitN(s, ".", 2)[0]
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := agent.Query("agent.ping", time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The hostname should only have been checked once
+	if keys := fake.received(); len(keys) != 4 {
+		t.Fatal("Expected one hostname check and three pings, got:", keys)
+	}
+}
+
+func TestHostnameMismatch(t *testing.T) {
+	items := map[string]string{"agent.hostname": "db01", "agent.ping": "1"}
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", items)
+
+	agent := fake.agent()
+	agent.ExpectedHostname = "web01"
+	agent.HostnameCheckInterval = time.Hour
+
+	_, err := agent.Query("agent.ping", time.Second)
+
+	var mismatch *HostnameMismatchError
+	if !errors.As(err, &mismatch) || !errors.Is(err, ErrHostnameMismatch) {
+		t.Fatal("Expected a HostnameMismatchError, got:", err)
+	}
+
+	if mismatch.Expected != "web01" || mismatch.Got != "db01" {
+		t.Fatalf("Unexpected names in %+v", mismatch)
+	}
+
+	// The failure is cached for HostnameCheckInterval
+	if _, err := agent.Query("agent.ping", time.Second); !errors.Is(err, ErrHostnameMismatch) {
+		t.Fatal("Expected the cached mismatch, got:", err)
+	}
+
+	if keys := fake.received(); len(keys) != 1 {
+		t.Fatal("Expected a single hostname check, got:", keys)
+	}
+
+	// Expire the check, now the hostname matches
+	agent.hostnameTime = time.Now().Add(-2 * time.Hour)
+	agent.ExpectedHostname = "DB01"
+
+	if _, err := agent.Query("agent.ping", time.Second); err != nil {
+		t.Fatal("Check should pass again, got:", err)
+	}
+}
@@ -0,0 +1,67 @@
+package zagent
+
+import (
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	influxKeyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+)
+
+/*
+	Write the numeric responses in metrics (keyed by item key) as a single
+	InfluxDB line protocol line for measurement, tagged with host and tags
+	and with a field per item key. Values are written as floats so a field
+	doesn't change type when the agent sends 1 then 1.5. Unsupported and
+	non-numeric values are skipped, as are tags with empty values, and
+	nothing is written if no value is left. There's no timestamp so the
+	server uses its own time.
+*/
+func WriteInflux(w io.Writer, measurement, host string, metrics map[string]*Response, tags map[string]string) error {
+	var fields []string
+	for key, res := range metrics {
+		if res == nil || !res.Supported() {
+			continue
+		}
+
+		f, err := strconv.ParseFloat(strings.TrimSpace(res.value()), 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			continue
+		}
+
+		fields = append(fields, influxKeyEscaper.Replace(key)+"="+strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	sort.Strings(fields)
+
+	allTags := map[string]string{}
+	for k, v := range tags {
+		allTags[k] = v
+	}
+	allTags["host"] = host
+
+	tagKeys := make([]string, 0, len(allTags))
+	for k, v := range allTags {
+		if v != "" {
+			tagKeys = append(tagKeys, k)
+		}
+	}
+	sort.Strings(tagKeys)
+
+	var line strings.Builder
+	line.WriteString(influxMeasurementEscaper.Replace(measurement))
+	for _, k := range tagKeys {
+		line.WriteString("," + influxKeyEscaper.Replace(k) + "=" + influxKeyEscaper.Replace(allTags[k]))
+	}
+	line.WriteString(" " + strings.Join(fields, ",") + "\n")
+
+	_, err := io.WriteString(w, line.String())
+	return err
+}
@@ -0,0 +1,32 @@
+package zagent
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteInflux(t *testing.T) {
+	metrics := map[string]*Response{
+		"system.cpu.load[all,avg1]": {Data: []byte("0.75")},
+		"proc.num[]":                {Data: []byte("312\n")},
+		"agent.version":             {Data: []byte("7.0.0")},
+		"no.such.key":               {Data: []byte(NotSupported)},
+		"missing":                   nil,
+	}
+	tags := map[string]string{"site": "eu west", "role": "db", "empty": ""}
+
+	var buf bytes.Buffer
+	if err := WriteInflux(&buf, "zabbix", "db1", metrics, tags); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `zabbix,host=db1,role=db,site=eu\ west proc.num[]=312,system.cpu.load[all\,avg1]=0.75` + "\n"
+	if buf.String() != want {
+		t.Fatalf("Expected:\n%sgot:\n%s", want, buf.String())
+	}
+
+	buf.Reset()
+	if err := WriteInflux(&buf, "zabbix", "db1", map[string]*Response{"agent.version": {Data: []byte("7.0.0")}}, nil); err != nil || buf.Len() != 0 {
+		t.Fatalf("Expected nothing without numeric values, got %q (%v)", buf.String(), err)
+	}
+}
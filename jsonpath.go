@@ -0,0 +1,129 @@
+package zagent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrPathNotFound is returned by DataJSONField when the path doesn't exist
+// in the response.
+var ErrPathNotFound = errors.New("path not found")
+
+/*
+	Decode Response.Data as JSON and return the value at path, e.g.
+	"memory.total" or "items[0].key". Object fields are separated by dots
+	and array elements selected with [n]. Values have the types
+	encoding/json uses for interface{}: numbers are float64, objects
+	map[string]interface{} and arrays []interface{}. Missing fields and
+	out of range indexes wrap ErrPathNotFound, non JSON data ErrNotJSON.
+*/
+func (r *Response) DataJSONField(path string) (interface{}, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(r.Data, &v); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotJSON, err)
+	}
+
+	walked := ""
+	for _, step := range steps {
+		at := walked + step.String()
+		if walked == "" {
+			at = strings.TrimPrefix(at, ".")
+		}
+
+		switch node := v.(type) {
+		case map[string]interface{}:
+			child, ok := node[step.field]
+			if step.field == "" || !ok {
+				return nil, fmt.Errorf("%s: %w%s", at, ErrPathNotFound, kindOf(walked, node))
+			}
+			v = child
+
+		case []interface{}:
+			if step.field != "" || step.index >= len(node) {
+				return nil, fmt.Errorf("%s: %w%s", at, ErrPathNotFound, kindOf(walked, node))
+			}
+			v = node[step.index]
+
+		default:
+			return nil, fmt.Errorf("%s: %w%s", at, ErrPathNotFound, kindOf(walked, node))
+		}
+
+		walked = at
+	}
+
+	return v, nil
+}
+
+// Describe the JSON value at path for error messages.
+func kindOf(path string, v interface{}) string {
+	if path == "" {
+		path = "value"
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return fmt.Sprintf(" (%s is an object)", path)
+	case []interface{}:
+		return fmt.Sprintf(" (%s is an array of %d elements)", path, len(v))
+	case string:
+		return fmt.Sprintf(" (%s is a string)", path)
+	case nil:
+		return fmt.Sprintf(" (%s is null)", path)
+	default:
+		return fmt.Sprintf(" (%s is %v)", path, v)
+	}
+}
+
+// A single step of a JSON path, either an object field or an array index.
+type jsonStep struct {
+	field string
+	index int
+}
+
+func (s jsonStep) String() string {
+	if s.field == "" {
+		return "[" + strconv.Itoa(s.index) + "]"
+	}
+	return "." + s.field
+}
+
+// Split a path like "items[0].key" into its steps.
+func parseJSONPath(path string) ([]jsonStep, error) {
+	if path == "" {
+		return nil, errors.New("empty JSON path")
+	}
+
+	var steps []jsonStep
+	for i, part := range strings.Split(path, ".") {
+		field, rest, _ := strings.Cut(part, "[")
+		if field == "" && (i > 0 || !strings.HasPrefix(part, "[")) {
+			return nil, fmt.Errorf("invalid JSON path %q: empty field", path)
+		}
+		if field != "" {
+			steps = append(steps, jsonStep{field: field})
+		}
+		if !strings.Contains(part, "[") {
+			continue
+		}
+
+		// rest is everything after the first "[", e.g. "0][1]"
+		for _, idx := range strings.Split(rest, "[") {
+			n, ok := strings.CutSuffix(idx, "]")
+			index, err := strconv.Atoi(n)
+			if !ok || err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid JSON path %q: bad index %q", path, "["+idx)
+			}
+			steps = append(steps, jsonStep{index: index})
+		}
+	}
+
+	return steps, nil
+}
@@ -0,0 +1,69 @@
+package zagent
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDataJSONField(t *testing.T) {
+	res := &Response{Data: []byte(`{
+		"memory": {"total": 8388608, "free": 1024},
+		"items": [{"key": "agent.ping"}, {"key": "agent.version", "tags": ["a", "b"]}],
+		"matrix": [[1, 2], [3, 4]]
+	}`)}
+
+	tests := []struct {
+		path  string
+		value interface{}
+	}{
+		{"memory.total", 8388608.0},
+		{"memory", map[string]interface{}{"total": 8388608.0, "free": 1024.0}},
+		{"items[0].key", "agent.ping"},
+		{"items[1].tags[1]", "b"},
+		{"matrix[1][0]", 3.0},
+	}
+
+	for _, test := range tests {
+		v, err := res.DataJSONField(test.path)
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, test.value) {
+			t.Errorf("%s: expected %v, got %v", test.path, test.value, v)
+		}
+	}
+
+	arr := &Response{Data: []byte(`[{"{#IFNAME}": "eth0"}]`)}
+	if v, err := arr.DataJSONField("[0].{#IFNAME}"); err != nil || v != "eth0" {
+		t.Error("Expected eth0, got:", v, err)
+	}
+}
+
+func TestDataJSONFieldErrors(t *testing.T) {
+	res := &Response{Data: []byte(`{"memory": {"total": 1}, "items": [{"key": "x"}]}`)}
+
+	missing := []string{"memory.used", "items[1]", "items.key", "memory[0]", "memory.total.bytes"}
+	for _, path := range missing {
+		if _, err := res.DataJSONField(path); !errors.Is(err, ErrPathNotFound) {
+			t.Errorf("%s: expected ErrPathNotFound, got %v", path, err)
+		}
+	}
+
+	if _, err := res.DataJSONField("memory.used"); err == nil || err.Error() != "memory.used: path not found (memory is an object)" {
+		t.Error("Unexpected error:", err)
+	}
+
+	invalid := []string{"", ".memory", "memory..total", "items[", "items[x]", "items[-1]", "items[0]key"}
+	for _, path := range invalid {
+		if _, err := res.DataJSONField(path); err == nil || errors.Is(err, ErrPathNotFound) {
+			t.Errorf("%q: expected an invalid path error, got %v", path, err)
+		}
+	}
+
+	notJSON := &Response{Data: []byte("ZBX_NOTSUPPORTED\x00Unsupported item key.")}
+	if _, err := notJSON.DataJSONField("memory"); !errors.Is(err, ErrNotJSON) {
+		t.Error("Expected ErrNotJSON, got:", err)
+	}
+}
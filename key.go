@@ -0,0 +1,32 @@
+package zagent
+
+import "strings"
+
+/*
+	Build an item key from its name and parameters, quoting parameters
+	where needed, e.g. BuildKey("vfs.fs.size", "/mnt/a,b", "free") returns
+	vfs.fs.size["/mnt/a,b",free]. A parameter is quoted if it contains a
+	comma, bracket or double quote or starts with a space, and double quotes
+	inside it are escaped with a backslash.
+*/
+func BuildKey(name string, params ...string) string {
+	if len(params) == 0 {
+		return name
+	}
+
+	quoted := make([]string, len(params))
+	for i, p := range params {
+		quoted[i] = quoteParam(p)
+	}
+
+	return name + "[" + strings.Join(quoted, ",") + "]"
+}
+
+// Quote a key parameter if it can't be passed as is.
+func quoteParam(p string) string {
+	if !strings.ContainsAny(p, `,"[]`) && !strings.HasPrefix(p, " ") {
+		return p
+	}
+
+	return `"` + strings.Replace(p, `"`, `\"`, -1) + `"`
+}
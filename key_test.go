@@ -0,0 +1,24 @@
+package zagent
+
+import "testing"
+
+func TestBuildKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		params []string
+		key    string
+	}{
+		{"agent.ping", nil, "agent.ping"},
+		{"vfs.fs.size", []string{"/", "free"}, "vfs.fs.size[/,free]"},
+		{"vfs.fs.size", []string{"/mnt/a,b", "free"}, `vfs.fs.size["/mnt/a,b",free]`},
+		{"vfs.file.exists", []string{`/tmp/"x"`}, `vfs.file.exists["/tmp/\"x\""]`},
+		{"system.run", []string{" ls", ""}, `system.run[" ls",]`},
+		{"proc.num", []string{"[kworker]"}, `proc.num["[kworker]"]`},
+	}
+
+	for _, test := range tests {
+		if key := BuildKey(test.name, test.params...); key != test.key {
+			t.Errorf("Expected %s, got %s", test.key, key)
+		}
+	}
+}
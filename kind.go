@@ -0,0 +1,113 @@
+package zagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ValueKind is the kind of value inferred from an agent's response.
+type ValueKind int
+
+const (
+	KindText    ValueKind = iota // Anything else, returned as a string
+	KindInteger                  // An int64, or uint64 if too large for int64
+	KindFloat                    // A float64
+	KindJSON                     // A JSON object or array, decoded as by encoding/json
+	KindBool                     // A bool, never inferred by default, see Agent.ValueClassifier
+)
+
+func (k ValueKind) String() string {
+	switch k {
+	case KindInteger:
+		return "integer"
+	case KindFloat:
+		return "float"
+	case KindJSON:
+		return "json"
+	case KindBool:
+		return "bool"
+	default:
+		return "text"
+	}
+}
+
+/*
+	Query the key and infer the kind of its value, with
+	Agent.ValueClassifier if set, returning the value parsed accordingly.
+	Surrounding white space is ignored when looking for numbers and JSON
+	but text is returned as is. A ZBX_NOTSUPPORTED reply is returned as a
+	*NotSupportedError, and a value that doesn't parse as the kind the
+	classifier chose as an error.
+*/
+func (a *Agent) GetTyped2(key string, timeout time.Duration) (value interface{}, kind ValueKind, err error) {
+	data, err := a.GetBytes(key, timeout)
+	if err != nil {
+		return nil, KindText, err
+	}
+
+	if a.ValueClassifier == nil {
+		value, kind = inferValue(data)
+		return value, kind, nil
+	}
+
+	kind = a.ValueClassifier(data)
+	if value, err = parseValue(data, kind); err != nil {
+		return nil, kind, fmt.Errorf("%s: value classified as %v: %w", key, kind, err)
+	}
+	return value, kind, nil
+}
+
+// Returns the kind of value data looks like, the default for GetTyped2.
+func ClassifyValue(data []byte) ValueKind {
+	_, kind := inferValue(data)
+	return kind
+}
+
+// Returns data parsed as the kind of value it looks like.
+func inferValue(data []byte) (interface{}, ValueKind) {
+	for _, kind := range []ValueKind{KindInteger, KindFloat, KindJSON} {
+		if value, err := parseValue(data, kind); err == nil {
+			return value, kind
+		}
+	}
+	return string(data), KindText
+}
+
+// Parse data as a value of kind.
+func parseValue(data []byte, kind ValueKind) (interface{}, error) {
+	data = trimBOM(data)
+	trimmed := string(bytes.TrimSpace(data))
+
+	switch kind {
+	case KindInteger:
+		if i, err := strconv.ParseInt(trimmed, 10, 64); err == nil {
+			return i, nil
+		}
+		return strconv.ParseUint(trimmed, 10, 64)
+
+	case KindFloat:
+		// ParseFloat accepts words like "inf" and "NaN" which are text here
+		f, err := strconv.ParseFloat(trimmed, 64)
+		if err == nil && (math.IsInf(f, 0) || math.IsNaN(f)) {
+			err = fmt.Errorf("%q is not a finite number", trimmed)
+		}
+		return f, err
+
+	case KindJSON:
+		if len(trimmed) == 0 || trimmed[0] != '{' && trimmed[0] != '[' {
+			return nil, ErrNotJSON
+		}
+		var v interface{}
+		err := json.Unmarshal([]byte(trimmed), &v)
+		return v, err
+
+	case KindBool:
+		return strconv.ParseBool(trimmed)
+	}
+
+	return string(data), nil
+}
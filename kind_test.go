@@ -0,0 +1,89 @@
+package zagent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetTyped2(t *testing.T) {
+	tests := []struct {
+		data  string
+		value interface{}
+		kind  ValueKind
+	}{
+		{"312", int64(312), KindInteger},
+		{"-5\n", int64(-5), KindInteger},
+		{"18446744073709551615", uint64(18446744073709551615), KindInteger},
+		{"0.25", 0.25, KindFloat},
+		{"1e3", 1000.0, KindFloat},
+		{`{"total": 8}`, map[string]interface{}{"total": 8.0}, KindJSON},
+		{`[{"{#FSNAME}": "/"}]`, []interface{}{map[string]interface{}{"{#FSNAME}": "/"}}, KindJSON},
+		{"Linux db1 6.1.0", "Linux db1 6.1.0", KindText},
+		{"{not json", "{not json", KindText},
+		{"inf", "inf", KindText},
+		{"NaN", "NaN", KindText},
+		{"", "", KindText},
+	}
+
+	items := map[string]string{}
+	for _, test := range tests {
+		items["key["+test.data+"]"] = test.data
+	}
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", items).agent()
+
+	for _, test := range tests {
+		value, kind, err := agent.GetTyped2("key["+test.data+"]", time.Second)
+		if err != nil {
+			t.Errorf("%q: %v", test.data, err)
+			continue
+		}
+		if kind != test.kind || !reflect.DeepEqual(value, test.value) {
+			t.Errorf("%q: expected %v %#v, got %v %#v", test.data, test.kind, test.value, kind, value)
+		}
+	}
+
+	if _, _, err := agent.GetTyped2("missing", time.Second); err == nil {
+		t.Error("Expected an error for an unsupported key")
+	}
+}
+
+func TestValueClassifier(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"net.tcp.port[,80]": "1",
+		"proc.num[nginx]":   "0",
+		"system.cpu.num":    "8",
+		"agent.version":     "7.0.0",
+	}).agent()
+
+	// Treat 0 and 1 as booleans and leave everything else to the default
+	agent.ValueClassifier = func(data []byte) ValueKind {
+		if s := string(data); s == "0" || s == "1" {
+			return KindBool
+		}
+		return ClassifyValue(data)
+	}
+
+	tests := []struct {
+		key   string
+		value interface{}
+		kind  ValueKind
+	}{
+		{"net.tcp.port[,80]", true, KindBool},
+		{"proc.num[nginx]", false, KindBool},
+		{"system.cpu.num", int64(8), KindInteger},
+		{"agent.version", "7.0.0", KindText},
+	}
+
+	for _, test := range tests {
+		value, kind, err := agent.GetTyped2(test.key, time.Second)
+		if err != nil || kind != test.kind || value != test.value {
+			t.Errorf("%s: expected %v %#v, got %v %#v (%v)", test.key, test.kind, test.value, kind, value, err)
+		}
+	}
+
+	agent.ValueClassifier = func([]byte) ValueKind { return KindInteger }
+	if _, kind, err := agent.GetTyped2("agent.version", time.Second); err == nil || kind != KindInteger {
+		t.Error("Expected an error parsing text as an integer, got:", kind, err)
+	}
+}
@@ -0,0 +1,171 @@
+package zagent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LoadOptions controls a LoadTest.
+type LoadOptions struct {
+	Concurrency int           // Number of concurrent workers. Defaults to 1.
+	Rate        float64       // Maximum queries per second across all workers, unlimited if < 1
+	Duration    time.Duration // How long to send queries for. Defaults to 10 seconds.
+
+	// Workers are started evenly over RampUp rather than all at once.
+	RampUp time.Duration
+}
+
+// LoadReport is the result of a LoadTest.
+type LoadReport struct {
+	Requests   int
+	Errors     map[string]int // Errors by category: timeout, refused, rejected, reset or other
+	Elapsed    time.Duration
+	Throughput float64 // Successful queries per second
+
+	// Latency percentiles of successful queries.
+	P50, P90, P99, Max time.Duration
+
+	// How long after the start the first connection was refused or
+	// rejected by the agent, zero if none were.
+	FirstRefused time.Duration
+}
+
+/*
+	Query the key on the agent as fast as the options allow and report how
+	it coped, e.g. before changing StartAgents. Queries go through
+	QueryContext like any other so the results reflect the library's real
+	behavior, each with the agent's Timeout. Cancelling the context stops
+	the test straight away, in-flight queries included, and the report of
+	what was done so far is returned with the context's error.
+*/
+func LoadTest(ctx context.Context, agent *Agent, key string, opts LoadOptions) (*LoadReport, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	if opts.Duration < 1 {
+		opts.Duration = 10 * time.Second
+	}
+
+	start := time.Now()
+	end := start.Add(opts.Duration)
+
+	var tokens <-chan time.Time
+	if opts.Rate >= 1 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer ticker.Stop()
+		tokens = ticker.C
+	}
+
+	report := &LoadReport{Errors: map[string]int{}}
+	var latencies []time.Duration
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < opts.Concurrency; i++ {
+		delay := opts.RampUp * time.Duration(i) / time.Duration(opts.Concurrency)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+
+			for time.Now().Before(end) {
+				if tokens != nil {
+					select {
+					case <-tokens:
+					case <-ctx.Done():
+						return
+					}
+				}
+				if ctx.Err() != nil || !time.Now().Before(end) {
+					return
+				}
+
+				sent := time.Now()
+				_, err := agent.QueryContext(ctx, key)
+				latency := time.Since(sent)
+
+				mu.Lock()
+				report.Requests++
+				if err == nil {
+					latencies = append(latencies, latency)
+				} else if ctx.Err() == nil {
+					category := loadErrorCategory(err)
+					report.Errors[category]++
+					if (category == "refused" || category == "rejected") && report.FirstRefused == 0 {
+						report.FirstRefused = time.Since(start)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	report.Elapsed = time.Since(start)
+	report.Throughput = float64(len(latencies)) / report.Elapsed.Seconds()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	if n := len(latencies); n > 0 {
+		report.P50 = latencies[n*50/100]
+		report.P90 = latencies[n*90/100]
+		report.P99 = latencies[n*99/100]
+		report.Max = latencies[n-1]
+	}
+
+	return report, ctx.Err()
+}
+
+// Returns the LoadReport.Errors category of err.
+func loadErrorCategory(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, ErrEmptyResponse):
+		return "rejected"
+	case errors.Is(err, ErrConnectionReset) || errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	}
+	return "other"
+}
+
+/*
+	Query a key with a large value, such as vfs.file.contents of a big
+	file, and measure how fast its data arrived. dur is the time from the
+	first byte of the response to the last, which leaves out connecting
+	and the agent computing the value, and bps is bytes (the size of the
+	data) per second over it. bps is 0 if the whole response arrived too
+	quickly to time. A ZBX_NOTSUPPORTED reply is returned as a
+	*NotSupportedError.
+*/
+func (a *Agent) MeasureThroughput(key string, timeout time.Duration) (bytes int, dur time.Duration, bps float64, err error) {
+	res, err := a.Query(key, timeout)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if err := res.notSupportedError(key); err != nil {
+		return 0, 0, 0, err
+	}
+
+	bytes, dur = len(res.Data), res.Timings.Read
+	if dur > 0 {
+		bps = float64(bytes) / dur.Seconds()
+	}
+
+	return bytes, dur, bps, nil
+}
@@ -0,0 +1,91 @@
+package zagent
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLoadTest(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "1"}).agent()
+
+	unlimited, err := loadTest(agent, LoadOptions{Concurrency: 4, Duration: 200 * time.Millisecond, RampUp: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlimited.Requests == 0 || len(unlimited.Errors) != 0 || unlimited.Throughput <= 0 {
+		t.Fatalf("Unexpected report: %+v", unlimited)
+	}
+	if unlimited.P50 <= 0 || unlimited.P50 > unlimited.P90 || unlimited.P90 > unlimited.P99 || unlimited.P99 > unlimited.Max {
+		t.Fatalf("Unexpected latencies: %+v", unlimited)
+	}
+
+	// A busy machine only slows the test down, so only the rate is an upper bound
+	limited, err := loadTest(agent, LoadOptions{Concurrency: 4, Rate: 50, Duration: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed := int(50*limited.Elapsed.Seconds()) + 1; limited.Requests < 1 || limited.Requests > allowed {
+		t.Fatalf("Expected 1 to %d requests at 50 per second, got: %d", allowed, limited.Requests)
+	}
+	if limited.Requests >= unlimited.Requests {
+		t.Fatalf("Expected fewer requests with a rate limit, got %d limited and %d unlimited", limited.Requests, unlimited.Requests)
+	}
+}
+
+func TestLoadTestRefused(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := agentFor(closed)
+	closed.Close()
+
+	report, err := loadTest(agent, LoadOptions{Duration: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Errors["refused"] != report.Requests || report.FirstRefused <= 0 {
+		t.Fatalf("Expected only refused connections, got: %+v", report)
+	}
+}
+
+func TestLoadTestCancel(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "1"}).agent()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := LoadTest(ctx, agent, "agent.ping", LoadOptions{Concurrency: 2, Duration: 10 * time.Second}); err != context.DeadlineExceeded {
+		t.Fatal("Expected context.DeadlineExceeded, got:", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("LoadTest didn't stop on cancellation")
+	}
+}
+
+// Run a load test of agent.ping.
+func loadTest(agent *Agent, opts LoadOptions) (*LoadReport, error) {
+	return LoadTest(context.Background(), agent, "agent.ping", opts)
+}
+
+func TestMeasureThroughput(t *testing.T) {
+	// 64KB in 1KB writes 5ms apart, so over 300ms from the first byte to the last
+	agent := agentFor(newSlowServer(t, 64<<10, 5*time.Millisecond))
+
+	bytes, dur, bps, err := agent.MeasureThroughput("vfs.file.contents[/var/log/big]", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes != 64<<10 || dur < 300*time.Millisecond {
+		t.Fatal("Unexpected measurement:", bytes, dur)
+	}
+
+	// A busy machine only makes it slower, so the pauses cap the rate
+	if bps < 1<<10 || bps > float64(bytes)/0.3 || bps != float64(bytes)/dur.Seconds() {
+		t.Fatal("Implausible rate:", bps)
+	}
+}
@@ -0,0 +1,122 @@
+package zagent
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+/*
+	PollPlan describes polling Keys on every one of Agents each Interval,
+	typically loaded from a JSON config such as:
+
+		{"Agents": [{"Host": "web01", "Port": 10050}],
+		 "Keys": ["agent.ping", "system.uptime"],
+		 "Interval": "30s", "Concurrency": 8, "Timeout": "5s"}
+
+	Run executes a single pass, callers schedule passes every Interval.
+*/
+type PollPlan struct {
+	Agents      []*Agent
+	Keys        []string
+	Interval    time.Duration
+	Concurrency int           // Maximum queries in flight, unlimited if < 1
+	Timeout     time.Duration // Timeout for each query, each Agent.Timeout or DefaultTimeout if < 1
+}
+
+// PollHandler receives the result of a single query of a PollPlan.
+type PollHandler func(host, key string, res *Response, err error)
+
+// pollPlanJSON is the JSON form of a PollPlan, with readable durations.
+type pollPlanJSON struct {
+	Agents      []*Agent
+	Keys        []string
+	Interval    string
+	Concurrency int    `json:",omitempty"`
+	Timeout     string `json:",omitempty"`
+}
+
+func (p PollPlan) MarshalJSON() ([]byte, error) {
+	plan := pollPlanJSON{
+		Agents:      p.Agents,
+		Keys:        p.Keys,
+		Interval:    p.Interval.String(),
+		Concurrency: p.Concurrency,
+	}
+
+	if p.Timeout > 0 {
+		plan.Timeout = p.Timeout.String()
+	}
+
+	return json.Marshal(plan)
+}
+
+func (p *PollPlan) UnmarshalJSON(b []byte) error {
+	plan := pollPlanJSON{}
+	if err := json.Unmarshal(b, &plan); err != nil {
+		return err
+	}
+
+	*p = PollPlan{Agents: plan.Agents, Keys: plan.Keys, Concurrency: plan.Concurrency}
+
+	var err error
+	if plan.Interval != "" {
+		if p.Interval, err = time.ParseDuration(plan.Interval); err != nil {
+			return err
+		}
+	}
+
+	if plan.Timeout != "" {
+		if p.Timeout, err = time.ParseDuration(plan.Timeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+	Query every key on every agent once and pass each result to handler
+	along with the agent's host:port. Calls to handler are serialized. If
+	the context is cancelled the remaining queries are skipped and the
+	context's error is returned.
+*/
+func (p *PollPlan) Run(ctx context.Context, handler PollHandler) error {
+	concurrency := p.Concurrency
+	if concurrency < 1 {
+		concurrency = len(p.Agents) * len(p.Keys)
+	}
+
+	var wg sync.WaitGroup
+	var handlerMu sync.Mutex
+	sem := make(chan struct{}, max(concurrency, 1))
+
+	for _, agent := range p.Agents {
+		for _, key := range p.Keys {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				wg.Wait()
+				return ctx.Err()
+			}
+
+			wg.Add(1)
+			go func(agent *Agent, key string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				queryCtx, cancel := context.WithTimeout(ctx, agent.timeout(p.Timeout))
+				res, err := agent.QueryContext(queryCtx, key)
+				cancel()
+
+				handlerMu.Lock()
+				defer handlerMu.Unlock()
+				handler(agent.hostPort(), key, res, err)
+			}(agent, key)
+		}
+	}
+	wg.Wait()
+
+	return ctx.Err()
+}
@@ -0,0 +1,104 @@
+package zagent
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPollPlanJSON(t *testing.T) {
+	in := `{"Agents":[{"Host":"web01","Port":10050},{"Host":"db01","Port":10051}],
+		"Keys":["agent.ping","system.uptime"],"Interval":"30s","Concurrency":4,"Timeout":"5s"}`
+
+	plan := PollPlan{}
+	if err := json.Unmarshal([]byte(in), &plan); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plan.Agents) != 2 || plan.Agents[1].Host != "db01" || plan.Agents[1].Port != 10051 {
+		t.Fatalf("Unexpected agents: %+v", plan.Agents)
+	}
+
+	if plan.Interval != 30*time.Second || plan.Timeout != 5*time.Second || plan.Concurrency != 4 {
+		t.Fatalf("Unexpected plan: %+v", plan)
+	}
+
+	out, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roundTrip := PollPlan{}
+	if err := json.Unmarshal(out, &roundTrip); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(roundTrip.Keys, plan.Keys) || roundTrip.Interval != plan.Interval ||
+		roundTrip.Agents[0].Host != "web01" {
+		t.Fatalf("Plan didn't round trip: %s", out)
+	}
+
+	if err := json.Unmarshal([]byte(`{"Interval":"soon"}`), &plan); err == nil {
+		t.Fatal("Expected an error for an invalid interval")
+	}
+}
+
+func TestPollPlanRun(t *testing.T) {
+	items := map[string]string{"agent.ping": "1", "system.uptime": "3600"}
+	plan := &PollPlan{
+		Agents: []*Agent{
+			newFakeAgent(t, "tcp", "127.0.0.1:0", items).agent(),
+			newFakeAgent(t, "tcp", "127.0.0.1:0", items).agent(),
+			newFakeAgent(t, "tcp", "127.0.0.1:0", items).agent(),
+		},
+		Keys:        []string{"agent.ping", "system.uptime", "agent.version"},
+		Concurrency: 2,
+		Timeout:     time.Second,
+	}
+
+	results := map[[2]string]string{}
+	err := plan.Run(context.Background(), func(host, key string, res *Response, err error) {
+		if err != nil {
+			t.Error(host, key, err)
+			return
+		}
+		results[[2]string{host, key}] = res.String()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 9 {
+		t.Fatal("Expected 9 results, got", len(results))
+	}
+
+	for _, agent := range plan.Agents {
+		host := agent.hostPort()
+		if results[[2]string{host, "system.uptime"}] != "3600" ||
+			results[[2]string{host, "agent.version"}] != NotSupported {
+			t.Fatalf("Unexpected results for %s: %v", host, results)
+		}
+	}
+}
+
+func TestPollPlanAgentTimeout(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "1"})
+	fake.script("agent.ping", fakeScript{headerDelay: 2 * time.Second})
+
+	// Without a plan timeout the agent's own applies
+	agent := fake.agent()
+	agent.Timeout = 50 * time.Millisecond
+	plan := &PollPlan{Agents: []*Agent{agent}, Keys: []string{"agent.ping"}}
+
+	var queryErr error
+	within(t, time.Second, func() {
+		plan.Run(context.Background(), func(host, key string, res *Response, err error) {
+			queryErr = err
+		})
+	})
+	if queryErr == nil {
+		t.Fatal("Expected the query to time out")
+	}
+}
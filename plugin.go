@@ -0,0 +1,170 @@
+package zagent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ErrNotJSON is returned by GetTyped when the value isn't JSON. This usually
+// means the key is served by the classic zabbix_agentd rather than an agent2
+// plugin.
+var ErrNotJSON = errors.New("response is not JSON")
+
+var (
+	pluginMu    sync.RWMutex
+	pluginTypes = map[string]func() interface{}{
+		"systemd.unit.get":      func() interface{} { return &SystemdUnit{} },
+		"docker.info":           func() interface{} { return &DockerInfo{} },
+		"docker.container_info": func() interface{} { return &DockerContainer{} },
+		"vfs.fs.get":            func() interface{} { return &[]FilesystemInfo{} },
+	}
+)
+
+// SystemdUnit is the result of the agent2 systemd.unit.get key.
+type SystemdUnit struct {
+	Id            string
+	Description   string
+	LoadState     string
+	ActiveState   string
+	SubState      string
+	UnitFileState string
+}
+
+// DockerInfo is the result of the agent2 docker.info key.
+type DockerInfo struct {
+	ID                string
+	Name              string
+	ServerVersion     string
+	Containers        int
+	ContainersRunning int
+	ContainersPaused  int
+	ContainersStopped int
+	Images            int
+	NCPU              int
+	MemTotal          int64
+}
+
+// DockerContainer is the result of the agent2 docker.container_info key.
+type DockerContainer struct {
+	ID    string `json:"Id"`
+	Name  string
+	Image string
+	State struct {
+		Status     string
+		Running    bool
+		Paused     bool
+		Restarting bool
+		ExitCode   int
+		StartedAt  string
+		FinishedAt string
+	}
+	RestartCount int
+}
+
+// FilesystemInfo is a single entry of the vfs.fs.get key.
+type FilesystemInfo struct {
+	Name   string `json:"fsname"`
+	Type   string `json:"fstype"`
+	Bytes  FilesystemUsage
+	Inodes FilesystemUsage
+}
+
+// FilesystemUsage holds the byte or inode usage of a FilesystemInfo.
+type FilesystemUsage struct {
+	Total uint64  `json:"total"`
+	Free  uint64  `json:"free"`
+	Used  uint64  `json:"used"`
+	PFree float64 `json:"pfree"`
+	PUsed float64 `json:"pused"`
+}
+
+/*
+	Register the Go type returned by keys starting with prefix (e.g.
+	"mysql.custom"). newFn must return a pointer that the JSON value can be
+	decoded into. Registering an existing prefix replaces it.
+*/
+func RegisterPluginType(prefix string, newFn func() interface{}) {
+	pluginMu.Lock()
+	defer pluginMu.Unlock()
+	pluginTypes[prefix] = newFn
+}
+
+/*
+	Returns a new value of the type registered for key, using the longest
+	registered prefix that matches the key name (the part before '['). A
+	prefix matches the whole name or up to a dot, so docker.info matches
+	docker.info and docker.info.custom but not docker.infox.
+*/
+func NewPluginValue(key string) (interface{}, bool) {
+	name := key
+	if i := strings.IndexByte(name, '['); i >= 0 {
+		name = name[:i]
+	}
+
+	pluginMu.RLock()
+	defer pluginMu.RUnlock()
+
+	var best string
+	var newFn func() interface{}
+	for prefix, fn := range pluginTypes {
+		matches := name == prefix || strings.HasPrefix(name, prefix+".")
+		if matches && len(prefix) > len(best) {
+			best, newFn = prefix, fn
+		}
+	}
+
+	if newFn == nil {
+		return nil, false
+	}
+	return newFn(), true
+}
+
+/*
+	Query the key and decode its JSON value into dest. Fields unknown to
+	dest are ignored so newer agent2 plugins don't break decoding. If the
+	value isn't JSON the returned error wraps ErrNotJSON.
+*/
+func (a *Agent) GetTyped(ctx context.Context, key string, dest interface{}) error {
+	res, err := a.QueryContext(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if err := res.notSupportedError(key); err != nil {
+		return err
+	}
+
+	if !json.Valid(res.Data) {
+		if a.knownVariant() == VariantAgentd {
+			return fmt.Errorf("%s: %w (served by zabbix_agentd)", key, ErrNotJSON)
+		}
+		return fmt.Errorf("%s: %w", key, ErrNotJSON)
+	}
+
+	if err := json.Unmarshal(res.Data, dest); err != nil {
+		return fmt.Errorf("%s: decoding into %T: %w", key, dest, err)
+	}
+
+	return nil
+}
+
+/*
+	Query the key and decode it into the type registered for it with
+	RegisterPluginType. The result is a pointer, e.g. *SystemdUnit.
+*/
+func (a *Agent) GetPlugin(ctx context.Context, key string) (interface{}, error) {
+	dest, ok := NewPluginValue(key)
+	if !ok {
+		return nil, fmt.Errorf("%s: no plugin type registered", key)
+	}
+
+	if err := a.GetTyped(ctx, key, dest); err != nil {
+		return nil, err
+	}
+
+	return dest, nil
+}
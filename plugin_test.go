@@ -0,0 +1,84 @@
+package zagent
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestGetTyped(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"systemd.unit.get[nginx.service]": `{"Id":"nginx.service","LoadState":"loaded","ActiveState":"active","SubState":"running","NewField":42}`,
+		"agent.version":                   "6.0.21",
+	})
+	agent := fake.agent()
+	ctx := context.Background()
+
+	unit := &SystemdUnit{}
+	if err := agent.GetTyped(ctx, "systemd.unit.get[nginx.service]", unit); err != nil {
+		t.Fatal(err)
+	}
+
+	if unit.ActiveState != "active" || unit.LoadState != "loaded" || unit.Id != "nginx.service" {
+		t.Fatalf("Unexpected unit: %+v", unit)
+	}
+
+	err := agent.GetTyped(ctx, "agent.version", unit)
+	if !errors.Is(err, ErrNotJSON) {
+		t.Fatal("Expected ErrNotJSON, got:", err)
+	}
+
+	var nse *NotSupportedError
+	err = agent.GetTyped(ctx, "docker.info", &DockerInfo{})
+	if !errors.As(err, &nse) || nse.Key != "docker.info" {
+		t.Fatal("Expected a NotSupportedError, got:", err)
+	}
+}
+
+func TestGetPlugin(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"vfs.fs.get": `[{"fsname":"/","fstype":"ext4","bytes":{"total":100,"free":25,"used":75,"pfree":25,"pused":75}}]`,
+	})
+
+	v, err := fake.agent().GetPlugin(context.Background(), "vfs.fs.get")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := *v.(*[]FilesystemInfo)
+	if len(fs) != 1 || fs[0].Name != "/" || fs[0].Bytes.Used != 75 {
+		t.Fatalf("Unexpected filesystems: %+v", fs)
+	}
+
+	if _, err := fake.agent().GetPlugin(context.Background(), "unknown.key"); err == nil {
+		t.Fatal("Expected an error for an unregistered key")
+	}
+}
+
+func TestNewPluginValue(t *testing.T) {
+	type custom struct{ Value int }
+	RegisterPluginType("docker.info.custom", func() interface{} { return &custom{} })
+	t.Cleanup(func() {
+		pluginMu.Lock()
+		defer pluginMu.Unlock()
+		delete(pluginTypes, "docker.info.custom")
+	})
+
+	v, ok := NewPluginValue("docker.info.custom[x]")
+	if !ok {
+		t.Fatal("Expected a registered type")
+	}
+
+	if _, ok := v.(*custom); !ok {
+		t.Fatalf("Longest prefix should win, got %T", v)
+	}
+
+	// Prefixes only match whole parts of the name
+	if v, ok := NewPluginValue("docker.infox"); ok {
+		t.Fatalf("docker.infox shouldn't match docker.info, got %T", v)
+	}
+	v, _ = NewPluginValue("docker.info.other[x]")
+	if _, ok := v.(*DockerInfo); !ok {
+		t.Fatalf("Expected a *DockerInfo, got %T", v)
+	}
+}
@@ -0,0 +1,163 @@
+package zagent
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Verdict is whether an agent supports a key.
+type Verdict int
+
+const (
+	VerdictSupported    Verdict = iota
+	VerdictNotSupported         // The agent replied ZBX_NOTSUPPORTED
+	VerdictError                // The key couldn't be queried, e.g. network errors or the deadline
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case VerdictSupported:
+		return "supported"
+	case VerdictNotSupported:
+		return "not supported"
+	}
+	return "error"
+}
+
+// KeyVerdict is the outcome of probing a single key.
+type KeyVerdict struct {
+	Key     string
+	Verdict Verdict
+	Reason  string // The agent's reason for VerdictNotSupported, if given
+	Err     error  // Only set for VerdictError
+}
+
+// ProbeOptions controls how ProbeKeys probes agents.
+type ProbeOptions struct {
+	Concurrency int           // Maximum number of keys in flight per agent. Defaults to 4.
+	Timeout     time.Duration // Deadline for probing all keys. Defaults to 30 seconds.
+}
+
+/*
+	Query every key and report whether the agent supports it, e.g. before
+	rolling out a template. Verdicts are in the order of keys. Unsupported
+	keys aren't errors, only failures to query them are. Once the deadline
+	passes the remaining keys get VerdictError and the context's error is
+	returned along with the verdicts.
+*/
+func (a *Agent) ProbeKeys(ctx context.Context, keys []string, opts ProbeOptions) ([]KeyVerdict, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 4
+	}
+	if opts.Timeout < 1 {
+		opts.Timeout = 30 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	verdicts := make([]KeyVerdict, len(keys))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.Concurrency)
+
+	for i, key := range keys {
+		verdicts[i] = KeyVerdict{Key: key}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			verdicts[i].Verdict, verdicts[i].Err = VerdictError, ctx.Err()
+			continue
+		}
+
+		wg.Add(1)
+		go func(v *KeyVerdict) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			a.probeKey(ctx, v)
+		}(&verdicts[i])
+	}
+	wg.Wait()
+
+	// Connection deadlines can expire just before the context's timer fires
+	if deadline, _ := ctx.Deadline(); ctx.Err() == nil && !time.Now().Before(deadline) {
+		return verdicts, context.DeadlineExceeded
+	}
+	return verdicts, ctx.Err()
+}
+
+// Fill in v's verdict.
+func (a *Agent) probeKey(ctx context.Context, v *KeyVerdict) {
+	res, err := a.QueryContext(ctx, v.Key)
+	if err != nil {
+		v.Verdict, v.Err = VerdictError, err
+		return
+	}
+
+	var nsErr *NotSupportedError
+	if errors.As(res.notSupportedError(v.Key), &nsErr) {
+		v.Verdict, v.Reason = VerdictNotSupported, nsErr.Reason
+		return
+	}
+
+	v.Verdict = VerdictSupported
+}
+
+// ProbeResult is the result of probing one agent of an AgentSet.
+type ProbeResult struct {
+	Agent    *Agent
+	Labels   map[string]string // A copy of Agent.Labels
+	Verdicts []KeyVerdict      // In the order of SupportMatrix.Keys
+	Err      error
+}
+
+// SupportMatrix is which keys each agent of an AgentSet supports.
+type SupportMatrix struct {
+	Keys    []string
+	Results []ProbeResult // In the set's order
+}
+
+/*
+	Probe the keys on every agent concurrently, see Agent.ProbeKeys. The
+	set's Concurrency limits the number of agents probed at once.
+*/
+func (s *AgentSet) ProbeKeys(ctx context.Context, keys []string, opts ProbeOptions) *SupportMatrix {
+	m := &SupportMatrix{Keys: append([]string(nil), keys...), Results: make([]ProbeResult, len(s.agents))}
+	s.each(func(i int, agent *Agent) {
+		verdicts, err := agent.ProbeKeys(ctx, keys, opts)
+		m.Results[i] = ProbeResult{Agent: agent, Labels: copyLabels(agent.Labels), Verdicts: verdicts, Err: err}
+	})
+	return m
+}
+
+/*
+	Write the matrix as CSV with a row per agent and a column per key. The
+	first column is the agent's address and each cell is the verdict,
+	followed by the reason for unsupported keys and the error for errors.
+*/
+func (m *SupportMatrix) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(append([]string{"agent"}, m.Keys...))
+
+	for _, r := range m.Results {
+		row := []string{r.Agent.String()}
+		for _, v := range r.Verdicts {
+			cell := v.Verdict.String()
+			switch {
+			case v.Verdict == VerdictNotSupported && v.Reason != "":
+				cell += ": " + v.Reason
+			case v.Verdict == VerdictError && v.Err != nil:
+				cell += ": " + v.Err.Error()
+			}
+			row = append(row, cell)
+		}
+		cw.Write(row)
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,75 @@
+package zagent
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeKeys(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"agent.ping":    "1",
+		"docker.info":   NotSupported + "\x00Unknown metric docker.info",
+		"system.cpu.ut": NotSupported,
+	}).agent()
+
+	verdicts, err := agent.ProbeKeys(context.Background(), []string{"agent.ping", "docker.info", "system.cpu.ut"}, ProbeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []KeyVerdict{
+		{Key: "agent.ping", Verdict: VerdictSupported},
+		{Key: "docker.info", Verdict: VerdictNotSupported, Reason: "Unknown metric docker.info"},
+		{Key: "system.cpu.ut", Verdict: VerdictNotSupported},
+	}
+	for i := range want {
+		if verdicts[i] != want[i] {
+			t.Errorf("Expected %+v, got %+v", want[i], verdicts[i])
+		}
+	}
+}
+
+func TestProbeKeysDeadline(t *testing.T) {
+	slow := agentFor(newRawServer(t, func(conn net.Conn) {
+		conn.Read(make([]byte, 512))
+		time.Sleep(200 * time.Millisecond)
+		conn.Write(encodeFrame([]byte("1")))
+	}))
+
+	start := time.Now()
+	verdicts, err := slow.ProbeKeys(context.Background(), []string{"a", "b", "c"}, ProbeOptions{Concurrency: 1, Timeout: 50 * time.Millisecond})
+	if err != context.DeadlineExceeded {
+		t.Fatal("Expected context.DeadlineExceeded, got:", err)
+	}
+	if time.Since(start) > 150*time.Millisecond {
+		t.Fatal("The deadline wasn't enforced")
+	}
+
+	for _, v := range verdicts {
+		if v.Verdict != VerdictError || v.Err == nil {
+			t.Errorf("Expected an error verdict, got %+v", v)
+		}
+	}
+}
+
+func TestSupportMatrix(t *testing.T) {
+	old := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "1"}).agent()
+	current := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "1", "vfs.fs.get": "[]"}).agent()
+
+	m := NewAgentSet(old, current).ProbeKeys(context.Background(), []string{"agent.ping", "vfs.fs.get"}, ProbeOptions{})
+
+	var b strings.Builder
+	if err := m.WriteCSV(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "agent,agent.ping,vfs.fs.get\n" +
+		old.String() + ",supported,not supported\n" +
+		current.String() + ",supported,supported\n"
+	if b.String() != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, b.String())
+	}
+}
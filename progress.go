@@ -0,0 +1,175 @@
+package zagent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+/*
+	ProgressFunc is called while reading a response with the number of data
+	bytes received so far and the total from the response's DataLength. It
+	runs inline with the read so it must return quickly.
+*/
+type ProgressFunc func(received, total uint64)
+
+type progressKey struct{}
+
+type progress struct {
+	fn       ProgressFunc
+	bytes    uint64
+	interval time.Duration
+}
+
+/*
+	Returns a context that reports the progress of reading responses for
+	queries made with it (e.g. QueryContext) to fn. fn is called at most
+	once every bytes received and every interval, whichever comes first, as
+	well as once the response is complete. If both are zero fn is called
+	after every read.
+*/
+func WithProgress(ctx context.Context, fn ProgressFunc, bytes uint64, interval time.Duration) context.Context {
+	return context.WithValue(ctx, progressKey{}, &progress{fn: fn, bytes: bytes, interval: interval})
+}
+
+type partialKey struct{}
+
+/*
+	Returns a context whose queries (e.g. QueryContext) keep the data
+	received so far if the connection fails part way through it, e.g. on a
+	deadline or cancellation. The query then returns both a Response with
+	Partial set and the error. Errors before any data arrives, and
+	compressed responses, still return no Response.
+*/
+func WithPartial(ctx context.Context) context.Context {
+	return context.WithValue(ctx, partialKey{}, true)
+}
+
+// Returns true if WithPartial was used.
+func partialFrom(ctx context.Context) bool {
+	partial, _ := ctx.Value(partialKey{}).(bool)
+	return partial
+}
+
+// Returns the progress set with WithProgress or nil.
+func progressFrom(ctx context.Context) *progress {
+	p, _ := ctx.Value(progressKey{}).(*progress)
+	return p
+}
+
+// progressReader reports the bytes read through it.
+type progressReader struct {
+	r        io.Reader
+	p        *progress
+	total    uint64
+	received uint64
+
+	lastBytes uint64
+	lastTime  time.Time
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	if pr.lastTime.IsZero() {
+		pr.lastTime = time.Now()
+	}
+
+	n, err := pr.r.Read(b)
+	pr.received += uint64(n)
+
+	if n > 0 && pr.due() {
+		pr.lastBytes, pr.lastTime = pr.received, time.Now()
+		pr.p.fn(pr.received, pr.total)
+	}
+
+	return n, err
+}
+
+// Returns true if the progress func should be called.
+func (pr *progressReader) due() bool {
+	switch {
+	case pr.received == pr.total:
+		return true
+	case pr.p.bytes == 0 && pr.p.interval == 0:
+		return true
+	case pr.p.bytes > 0 && pr.received-pr.lastBytes >= pr.p.bytes:
+		return true
+	case pr.p.interval > 0 && time.Since(pr.lastTime) >= pr.p.interval:
+		return true
+	}
+	return false
+}
+
+// rateReader fails with ErrTooSlow if data arrives slower than rate bytes per
+// second over a window, starting from the first byte.
+type rateReader struct {
+	r      io.Reader
+	rate   float64
+	window time.Duration
+
+	start time.Time
+	n     int
+}
+
+func (rr *rateReader) Read(b []byte) (int, error) {
+	n, err := rr.r.Read(b)
+	if n == 0 {
+		return n, err
+	}
+
+	if rr.start.IsZero() {
+		rr.start = time.Now()
+	}
+	rr.n += n
+
+	window := rr.window
+	if window < 1 {
+		window = time.Second
+	}
+
+	if elapsed := time.Since(rr.start); elapsed >= window {
+		if float64(rr.n)/elapsed.Seconds() < rr.rate {
+			return n, ErrTooSlow
+		}
+		rr.start, rr.n = time.Now(), 0
+	}
+
+	return n, err
+}
+
+/*
+	idleReader fails reads with ErrIdleTimeout when nothing arrives for
+	idle, by moving the connection's read deadline forward before every
+	read. It never moves it past the context's deadline and stops moving it
+	once the context is done so cancellation still unblocks reads.
+*/
+type idleReader struct {
+	ctx  context.Context
+	conn net.Conn
+	idle time.Duration
+}
+
+func (ir *idleReader) Read(b []byte) (int, error) {
+	deadline := time.Now().Add(ir.idle)
+	idleBound := true
+	if d, ok := ir.ctx.Deadline(); ok && d.Before(deadline) {
+		deadline, idleBound = d, false
+	}
+
+	if ir.ctx.Err() == nil {
+		ir.conn.SetReadDeadline(deadline)
+		// The context may have been cancelled while we moved the deadline
+		if ir.ctx.Err() != nil {
+			ir.conn.SetReadDeadline(time.Unix(1, 0))
+		}
+	}
+
+	n, err := ir.conn.Read(b)
+	if idleBound && errors.Is(err, os.ErrDeadlineExceeded) && ir.ctx.Err() == nil {
+		return n, ErrIdleTimeout
+	}
+
+	return n, err
+}
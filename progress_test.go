@@ -0,0 +1,175 @@
+package zagent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Start a server that responds with size bytes written in 1KB chunks, pausing
+// between each.
+func newSlowServer(t *testing.T, size int, pause time.Duration) net.Listener {
+	frame := encodeFrame(bytes.Repeat([]byte("x"), size))
+
+	return newRawServer(t, func(conn net.Conn) {
+		frame := frame
+		conn.Read(make([]byte, 512))
+		for len(frame) > 0 {
+			n := min(1024, len(frame))
+			if _, err := conn.Write(frame[:n]); err != nil {
+				return
+			}
+			frame = frame[n:]
+			time.Sleep(pause)
+		}
+	})
+}
+
+func TestProgress(t *testing.T) {
+	agent := agentFor(newSlowServer(t, 16<<10, time.Millisecond))
+
+	var calls [][2]uint64
+	ctx := WithProgress(context.Background(), func(received, total uint64) {
+		calls = append(calls, [2]uint64{received, total})
+	}, 4096, 0)
+
+	res, err := agent.QueryContext(ctx, "vfs.file.contents[/var/log/big]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) < 4 || len(calls) > 5 {
+		t.Fatal("Expected a call every 4KB, got:", calls)
+	}
+
+	last := calls[len(calls)-1]
+	if last[0] != uint64(len(res.Data)) || last[1] != 16<<10 {
+		t.Fatal("The last call should report the whole response, got:", last)
+	}
+
+	for i := 1; i < len(calls); i++ {
+		if calls[i][0] <= calls[i-1][0] {
+			t.Fatal("Progress should only increase, got:", calls)
+		}
+	}
+}
+
+func TestProgressCancel(t *testing.T) {
+	agent := agentFor(newSlowServer(t, 64<<10, 5*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var once sync.Once
+	ctx = WithProgress(ctx, func(received, total uint64) {
+		once.Do(cancel)
+	}, 0, 0)
+
+	start := time.Now()
+	_, err := agent.QueryContext(ctx, "vfs.file.contents[/var/log/big]")
+	if err != context.Canceled {
+		t.Fatal("Expected context.Canceled, got:", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatal("Cancelling should abort the download, took", elapsed)
+	}
+}
+
+func TestMinReadRate(t *testing.T) {
+	frame := encodeFrame(bytes.Repeat([]byte("x"), 100))
+	ln := newRawServer(t, func(conn net.Conn) {
+		conn.Read(make([]byte, 512))
+		for _, b := range frame {
+			if _, err := conn.Write([]byte{b}); err != nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+
+	agent := agentFor(ln)
+	agent.MinReadRate = 100
+	agent.MinReadRateWindow = 300 * time.Millisecond
+
+	start := time.Now()
+	_, err := agent.Query("vfs.file.contents[/var/log/big]", 10*time.Second)
+	if err != ErrTooSlow {
+		t.Fatal("Expected ErrTooSlow, got:", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("The slow agent should have been aborted after the window, took", elapsed)
+	}
+}
+
+func TestMinReadRateFastEnough(t *testing.T) {
+	agent := agentFor(newSlowServer(t, 16<<10, 10*time.Millisecond))
+	agent.MinReadRate = 10 << 10
+	agent.MinReadRateWindow = 50 * time.Millisecond
+
+	if _, err := agent.Query("vfs.file.contents[/var/log/big]", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartial(t *testing.T) {
+	agent := agentFor(newSlowServer(t, 16<<10, 50*time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Millisecond)
+	defer cancel()
+	if res, err := agent.QueryContext(ctx, "vfs.file.contents[/var/log/big]"); res != nil || err == nil {
+		t.Fatal("Expected no response without WithPartial, got:", res, err)
+	}
+
+	ctx, cancel = context.WithTimeout(WithPartial(context.Background()), 120*time.Millisecond)
+	defer cancel()
+	res, err := agent.QueryContext(ctx, "vfs.file.contents[/var/log/big]")
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatal("Expected a timeout, got:", err)
+	}
+	if res == nil || !res.Partial || res.DataLength != 16<<10 || len(res.Data) == 0 || len(res.Data) >= 16<<10 {
+		t.Fatalf("Unexpected partial response: %+v", res)
+	}
+	if !bytes.Equal(res.Data, bytes.Repeat([]byte("x"), len(res.Data))) {
+		t.Fatal("Unexpected partial data")
+	}
+
+	// Complete responses are never partial
+	agent = agentFor(newSlowServer(t, 4096, 0))
+	res, err = agent.QueryContext(WithPartial(context.Background()), "vfs.file.contents[/etc/motd]")
+	if err != nil || res.Partial || res.DataLength != 4096 {
+		t.Fatalf("Unexpected response: %+v (%v)", res, err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	// Longer in total than the idle timeout but never idle for that long
+	agent := agentFor(newSlowServer(t, 8<<10, 30*time.Millisecond))
+	agent.IdleTimeout = 150 * time.Millisecond
+
+	if _, err := agent.Query("vfs.file.contents[/var/log/big]", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	agent = agentFor(newSlowServer(t, 8<<10, 300*time.Millisecond))
+	agent.IdleTimeout = 100 * time.Millisecond
+
+	if _, err := agent.Query("vfs.file.contents[/var/log/big]", 5*time.Second); err != ErrIdleTimeout {
+		t.Fatal("Expected ErrIdleTimeout, got:", err)
+	}
+
+	// The overall timeout still applies and isn't reported as idle
+	agent = agentFor(newSlowServer(t, 8<<10, 30*time.Millisecond))
+	agent.IdleTimeout = 150 * time.Millisecond
+
+	_, err := agent.Query("vfs.file.contents[/var/log/big]", 100*time.Millisecond)
+	if err == nil || err == ErrIdleTimeout {
+		t.Fatal("Expected the overall timeout, got:", err)
+	}
+}
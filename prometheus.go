@@ -0,0 +1,94 @@
+package zagent
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	Write the numeric responses in metrics (keyed by item key) in the
+	Prometheus text exposition format as gauges labelled with host. Metric
+	names come from nameMap, keys missing from it are named after the key
+	with invalid characters replaced by underscores. Unsupported and
+	non-numeric values are skipped. Metrics are written in name order and
+	nothing is written if two keys end up with the same name.
+*/
+func RenderPrometheus(w io.Writer, host string, metrics map[string]*Response, nameMap map[string]string) error {
+	type sample struct {
+		name  string
+		key   string
+		value string // As sent by the agent, once it's known to parse
+	}
+
+	samples := make([]sample, 0, len(metrics))
+	for key, res := range metrics {
+		if res == nil || !res.Supported() {
+			continue
+		}
+
+		value := strings.TrimSpace(res.value())
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			continue
+		}
+
+		name, ok := nameMap[key]
+		if !ok {
+			name = metricName(key)
+		}
+		samples = append(samples, sample{name, key, value})
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].name != samples[j].name {
+			return samples[i].name < samples[j].name
+		}
+		return samples[i].key < samples[j].key
+	})
+
+	// Every sample has the same labels so a shared name would be a duplicate series
+	for i := 1; i < len(samples); i++ {
+		if samples[i].name == samples[i-1].name {
+			return fmt.Errorf("keys %s and %s both map to metric %s", samples[i-1].key, samples[i].key, samples[i].name)
+		}
+	}
+
+	labels := `{host="` + escapeLabel(host) + `"}`
+	for _, s := range samples {
+		if _, err := fmt.Fprintf(w, "# TYPE %s gauge\n", s.name); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", s.name, labels, s.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Turn an item key into a valid metric name, e.g. system.cpu.load[all,avg1] to system_cpu_load_all_avg1.
+func metricName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, key)
+
+	name = strings.Trim(name, "_")
+	for strings.Contains(name, "__") {
+		name = strings.Replace(name, "__", "_", -1)
+	}
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// Escape a label value for the text exposition format.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
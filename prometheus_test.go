@@ -0,0 +1,60 @@
+package zagent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderPrometheus(t *testing.T) {
+	metrics := map[string]*Response{
+		"system.cpu.load[all,avg1]": {Data: []byte("0.75")},
+		"vm.memory.size[available]": {Data: []byte("1073741824")},
+		"agent.ping":                {Data: []byte("1")},
+		"system.uname":              {Data: []byte("Linux web01")},
+		"docker.info":               {Data: []byte(NotSupported)},
+		"vfs.fs.size[/,used]":       {Data: []byte("\xef\xbb\xbf42")},
+	}
+	nameMap := map[string]string{
+		"vm.memory.size[available]": "node_memory_available_bytes",
+		"agent.ping":                "zabbix_agent_up",
+	}
+
+	var b strings.Builder
+	if err := RenderPrometheus(&b, `web"01`, metrics, nameMap); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# TYPE node_memory_available_bytes gauge
+node_memory_available_bytes{host="web\"01"} 1073741824
+# TYPE system_cpu_load_all_avg1 gauge
+system_cpu_load_all_avg1{host="web\"01"} 0.75
+# TYPE vfs_fs_size_used gauge
+vfs_fs_size_used{host="web\"01"} 42
+# TYPE zabbix_agent_up gauge
+zabbix_agent_up{host="web\"01"} 1
+`
+	if b.String() != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, b.String())
+	}
+}
+
+func TestRenderPrometheusCollision(t *testing.T) {
+	metrics := map[string]*Response{
+		"net.if.in[eth0]":  {Data: []byte("1")},
+		"net.if.in[eth0,]": {Data: []byte("2")},
+	}
+
+	var b strings.Builder
+	err := RenderPrometheus(&b, "web01", metrics, nil)
+	if err == nil || !strings.Contains(err.Error(), "net_if_in_eth0") {
+		t.Fatal("Expected a collision error, got:", err)
+	}
+	if b.Len() != 0 {
+		t.Fatalf("Expected nothing to be written, got:\n%s", b.String())
+	}
+
+	// Mapping one of them elsewhere resolves it
+	if err := RenderPrometheus(&b, "web01", metrics, map[string]string{"net.if.in[eth0,]": "eth0_in"}); err != nil {
+		t.Fatal(err)
+	}
+}
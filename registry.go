@@ -0,0 +1,91 @@
+package zagent
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Registry looks agents up by name, e.g. names from a config file. It's safe for concurrent use.
+type Registry struct {
+	mu     sync.RWMutex
+	agents map[string]*Agent
+}
+
+// Creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{agents: make(map[string]*Agent)}
+}
+
+// Register the agent under name, replacing any agent already registered with it.
+func (r *Registry) Register(name string, a *Agent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.agents[name] = a
+}
+
+// Returns the agent registered under name.
+func (r *Registry) Get(name string) (*Agent, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	a, ok := r.agents[name]
+	return a, ok
+}
+
+// Returns the registered names in order.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.agents))
+	for name := range r.agents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+/*
+	Query the key on the agent registered under name, using the agent's
+	Timeout or DefaultTimeout.
+*/
+func (r *Registry) GetResponse(name, key string) (*Response, error) {
+	a, ok := r.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("no agent registered as %q", name)
+	}
+
+	return a.Query(key, 0)
+}
+
+/*
+	Call agent.ping on every registered agent, at most concurrency at once
+	(unlimited if < 1), e.g. as a readiness check at startup. Every name is
+	in the result with a nil error if the agent is healthy.
+*/
+func (r *Registry) ValidateAll(timeout time.Duration, concurrency int) map[string]error {
+	names := r.Names()
+	agents := make([]*Agent, len(names))
+	for i, name := range names {
+		agents[i], _ = r.Get(name)
+	}
+
+	set := &AgentSet{agents: agents, Concurrency: concurrency}
+	results := make(map[string]error, len(names))
+	var mu sync.Mutex
+
+	set.each(func(i int, agent *Agent) {
+		ok, err := agent.AgentPing(timeout)
+		if err == nil && !ok {
+			err = ErrPingFailed
+		}
+
+		mu.Lock()
+		results[names[i]] = err
+		mu.Unlock()
+	})
+
+	return results
+}
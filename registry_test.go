@@ -0,0 +1,76 @@
+package zagent
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	db := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.hostname": "db01"}).agent()
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"db", "web", "cache"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			r.Register(name, NewAgent(name+".example.com"))
+		}(name)
+	}
+	wg.Wait()
+	r.Register("db", db)
+
+	if !reflect.DeepEqual(r.Names(), []string{"cache", "db", "web"}) {
+		t.Fatal("Unexpected names:", r.Names())
+	}
+
+	if a, ok := r.Get("db"); !ok || a != db {
+		t.Fatal("Expected the last agent registered as db, got:", a)
+	}
+	if _, ok := r.Get("missing"); ok {
+		t.Fatal("Expected no agent for an unknown name")
+	}
+
+	res, err := r.GetResponse("db", "agent.hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.String() != "db01" {
+		t.Fatal("Unexpected response:", res.String())
+	}
+
+	if _, err := r.GetResponse("missing", "agent.hostname"); err == nil {
+		t.Fatal("Expected an error for an unknown name")
+	}
+}
+
+func TestValidateAll(t *testing.T) {
+	r := NewRegistry()
+	r.Register("up", newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "1"}).agent())
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Register("down", agentFor(closed))
+	closed.Close()
+	r.Register("wrong", newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "0"}).agent())
+
+	results := r.ValidateAll(time.Second, 1)
+	if len(results) != 3 {
+		t.Fatal("Expected a result per agent, got:", results)
+	}
+	if err, ok := results["up"]; !ok || err != nil {
+		t.Error("Expected up to be healthy, got:", err)
+	}
+	if results["down"] == nil {
+		t.Error("Expected down to fail")
+	}
+	if !errors.Is(results["wrong"], ErrPingFailed) {
+		t.Error("Expected ErrPingFailed, got:", results["wrong"])
+	}
+}
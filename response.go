@@ -1,12 +1,16 @@
 package zagent
 
 import (
-	"bufio"
-	"encoding/binary"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+	"unsafe"
 )
 
 // Response is the response from the zabbix agent.
@@ -17,11 +21,90 @@ type Response struct {
 	Header     []byte // This should always be: ZBXD\x01
 	DataLength uint64 // The size of the response
 	Data       []byte // The results of the query
+
+	ReceivedAt time.Time // When the whole response had been read
+	Timings    Timings   // How long each phase of the query took
+
+	// True if the connection failed part way through the data and
+	// WithPartial was used. Data holds what was received and DataLength
+	// the length the agent declared.
+	Partial bool
+
+	FromCache bool      // True if the response was served by a Cache
+	FetchedAt time.Time // When a Cache fetched the response from the agent
+
+	unsupported func([]byte) bool // Agent.UnsupportedFunc of the agent that sent it
 }
 
-// Returns true if the key is supported, false if it wasn't.
+/*
+	Timings break down how long a query took. Dial includes resolving the
+	agent's host and is zero for keys sent over an already open Session
+	connection. A slow Dial points at the network, a slow TimeToFirstByte
+	at the agent computing the item and a slow Read at a large value or a
+	congested link.
+*/
+type Timings struct {
+	Dial            time.Duration // Establishing the connection
+	Write           time.Duration // Sending the key
+	TimeToFirstByte time.Duration // From sending the key to the first byte of the response
+	Read            time.Duration // From the first byte to the end of the response
+}
+
+// Returns the total time taken by all phases.
+func (t Timings) Total() time.Duration {
+	return t.Dial + t.Write + t.TimeToFirstByte + t.Read
+}
+
+// Records when the first byte was read through it.
+type firstByteReader struct {
+	r     io.Reader
+	first time.Time
+}
+
+func (fr *firstByteReader) Read(b []byte) (int, error) {
+	n, err := fr.r.Read(b)
+	if n > 0 && fr.first.IsZero() {
+		fr.first = time.Now()
+	}
+	return n, err
+}
+
+/*
+	Returns true if the key is supported, false if it wasn't. Only data
+	starting with ZBX_NOTSUPPORTED, bare or followed by the reason, counts
+	as unsupported, unless the response came from an Agent with
+	UnsupportedFunc set.
+*/
 func (r *Response) Supported() bool {
-	return !strings.Contains(r.String(), NotSupported)
+	if r.unsupported != nil {
+		return !r.unsupported(r.Data)
+	}
+	return !bytes.HasPrefix(r.Data, notSupported)
+}
+
+var notSupported = []byte(NotSupported)
+
+// Returns a *NotSupportedError for key if the agent didn't support it, nil otherwise.
+func (r *Response) notSupportedError(key string) error {
+	if r.Supported() {
+		return nil
+	}
+
+	reason := ""
+	if i := strings.IndexByte(r.String(), 0); i >= 0 {
+		reason = r.String()[i+1:]
+	}
+
+	return &NotSupportedError{Key: key, Reason: reason}
+}
+
+/*
+	Returns true if Response.Data is valid UTF-8 and contains no NUL bytes.
+	Some keys (e.g. custom UserParameters) return raw bytes which callers
+	may want to handle differently. Response.Data is never altered.
+*/
+func (r *Response) IsText() bool {
+	return utf8.Valid(r.Data) && bytes.IndexByte(r.Data, 0) < 0
 }
 
 // Convenience wrapper to return Response.Data as a string.
@@ -29,24 +112,114 @@ func (r *Response) String() string {
 	return string(r.Data)
 }
 
+// A UTF-8 byte order mark, which some Windows agent items put before their value.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// Returns data without a leading UTF-8 byte order mark.
+func trimBOM(data []byte) []byte {
+	return bytes.TrimPrefix(data, utf8BOM)
+}
+
+/*
+	Returns Response.Data as a string without a leading UTF-8 byte order
+	mark, for the accessors that parse the value. Data itself is kept raw.
+*/
+func (r *Response) value() string {
+	return string(trimBOM(r.Data))
+}
+
+/*
+	Returns Response.Data as a string without copying it, for hot paths
+	that compare many values. The string shares Response.Data's memory so
+	it must not be kept after Data is modified or reused, and Data must not
+	be modified while the string is in use. Use String everywhere else.
+*/
+func (r *Response) DataAsStringNoCopy() string {
+	return unsafe.String(unsafe.SliceData(r.Data), len(r.Data))
+}
+
+/*
+	Returns Response.Data with the key parameter quoting BuildKey applies
+	reversed, for values that echo a quoted parameter back. If Data is
+	enclosed in double quotes they're removed and every \" inside becomes
+	". That's the only escape sequence, other backslashes and brackets
+	are kept as they are. Data that isn't quoted is returned unchanged.
+*/
+func (r *Response) DataUnescaped() string {
+	s := r.String()
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+
+	return strings.Replace(s[1:len(s)-1], `\"`, `"`, -1)
+}
+
 // Convenience wrapper to return Response.Data as a bool.
 func (r *Response) Bool() (bool, error) {
-	return strconv.ParseBool(r.String())
+	return strconv.ParseBool(r.value())
 }
 
 // Convenience wrapper to return Response.Data as an int.
 func (r *Response) Int() (int, error) {
-	return strconv.Atoi(r.String())
+	return strconv.Atoi(r.value())
 }
 
 // Convenience wrapper to return Response.Data as an int64.
 func (r *Response) Int64() (int64, error) {
-	return strconv.ParseInt(r.String(), 10, 64)
+	return strconv.ParseInt(r.value(), 10, 64)
 }
 
 // Convenience wrapper to return Response.Data as an float64.
 func (r *Response) Float64() (float64, error) {
-	return strconv.ParseFloat(r.String(), 64)
+	return strconv.ParseFloat(r.value(), 64)
+}
+
+/*
+	Returns Response.Data, with surrounding white space trimmed, both as a
+	float64 and as the string it was parsed from. The string is returned
+	even if it isn't a number.
+*/
+func (r *Response) DataAsFloat64WithRaw() (float64, string, error) {
+	raw := strings.TrimSpace(r.value())
+	f, err := strconv.ParseFloat(raw, 64)
+	return f, raw, err
+}
+
+/*
+	ResultProto is a response flattened into plain fields for mapping onto
+	protobuf or other serialization formats.
+*/
+type ResultProto struct {
+	Host             string
+	Key              string
+	Value            []byte // Response.Data, empty if not supported
+	Supported        bool
+	Error            string // Why the key isn't supported, empty if it is
+	ReceivedUnixNano int64  // Response.ReceivedAt, 0 if unset
+}
+
+/*
+	Flatten the response to key from host into a ResultProto. The
+	response doesn't record its key so it must be passed in. Value is a
+	copy of Data.
+*/
+func (r *Response) ToResult(host, key string) ResultProto {
+	result := ResultProto{Host: host, Key: key, Supported: r.Supported()}
+
+	if nsErr, ok := r.notSupportedError(key).(*NotSupportedError); ok {
+		result.Error = nsErr.Reason
+		if result.Error == "" {
+			result.Error = nsErr.Error()
+		}
+	} else {
+		result.Value = append([]byte(nil), r.Data...)
+	}
+
+	if !r.ReceivedAt.IsZero() {
+		result.ReceivedUnixNano = r.ReceivedAt.UnixNano()
+	}
+
+	return result
 }
 
 /*
@@ -55,24 +228,24 @@ func (r *Response) Float64() (float64, error) {
 */
 func (r *Response) Interface() interface{} {
 	// Attempt int64
-	i, err := strconv.ParseInt(r.String(), 10, 64)
+	i, err := strconv.ParseInt(r.value(), 10, 64)
 	if err == nil {
 		return i
 	}
 
 	// Attempt float64
-	f, err := strconv.ParseFloat(r.String(), 64)
+	f, err := strconv.ParseFloat(r.value(), 64)
 	if err == nil {
 		return f
 	}
 
 	// Attempt bool
-	b, err := strconv.ParseBool(r.String())
+	b, err := strconv.ParseBool(r.value())
 	if err == nil {
 		return b
 	}
 
-	return r.String()
+	return r.value()
 }
 
 // Create a new Response type
@@ -83,24 +256,63 @@ func newResponse() *Response {
 	}
 }
 
+/*
+	Parse a response in the ZBXD wire format (see ReadFrame). A connection
+	that ends before the whole response is read returns ErrTruncatedResponse,
+	or ErrConnectionReset if the agent reset it.
+*/
 func ParseResponse(rd io.Reader) (*Response, error) {
+	return parseResponse(rd, 0, nil, false, nil)
+}
+
+/*
+	Parse a single frame held in memory, e.g. bytes captured off the wire.
+	Anything after the frame is ignored.
+*/
+func ResponseFromBytes(frame []byte) (*Response, error) {
+	return ParseResponse(bytes.NewReader(frame))
+}
+
+/*
+	Parse a response with at most maxSize bytes of data (0 for no limit),
+	reporting the progress of reading the data to p if not nil. If partial
+	is set and reading the data fails part way, the data received so far is
+	returned as a partial Response along with the error. reserve is passed
+	to readFrame.
+*/
+func parseResponse(rd io.Reader, maxSize uint64, p *progress, partial bool, reserve func(uint64) error) (*Response, error) {
+	f, dataLen, err := readFrame(rd, maxSize, p, reserve)
+	switch {
+	case err == io.EOF:
+		return nil, ErrEmptyResponse
+	case errors.Is(err, syscall.ECONNRESET) && !errors.Is(err, ErrConnectionReset):
+		// Reset before sending anything, agents do this when rejecting us
+		return nil, ErrEmptyResponse
+	case err != nil && !(partial && f.Data != nil):
+		return nil, err
+	}
+
 	res := newResponse()
-	dataLength := make([]byte, 8)
-
-	reader := bufio.NewReader(rd)
-	reader.Read(res.Header)
-	reader.Read(dataLength)
-	res.Data, _ = ioutil.ReadAll(reader)
-
-	// Convert dataLength from binary to uint
-	var bytesRead int
-	res.DataLength, bytesRead = binary.Uvarint(dataLength)
-	if bytesRead <= 0 {
-		if bytesRead == 0 {
-			return nil, DataLengthBufferTooSmall
-		}
-		return nil, DataLengthOverflow
+	copy(res.Header, "ZBXD")
+	res.Header[4] = f.Flags
+	res.Data = f.Data
+	res.DataLength = uint64(len(f.Data))
+	res.ReceivedAt = time.Now()
+
+	if err != nil {
+		res.Partial, res.DataLength = true, dataLen
 	}
 
-	return res, nil
+	return res, err
+}
+
+// Classify an error that occurred after part of the response was read.
+func readError(err error) error {
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return ErrTruncatedResponse
+	case errors.Is(err, syscall.ECONNRESET):
+		return fmt.Errorf("%w: %w", ErrConnectionReset, err)
+	}
+	return err
 }
@@ -0,0 +1,409 @@
+package zagent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestBinarySafeData(t *testing.T) {
+	random := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	payloads := map[string][]byte{
+		"nul":     []byte("abc\x00def\x00"),
+		"invalid": []byte("caf\xc3\x28\xff\xfe"),
+		"random":  random,
+	}
+
+	items := map[string]string{}
+	for key, data := range payloads {
+		items[key] = string(data)
+	}
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", items).agent()
+
+	for key, want := range payloads {
+		res, err := agent.Query(key, 5*time.Second)
+		if err != nil {
+			t.Fatal(key, err)
+		}
+
+		// Run every accessor and make sure none of them alter Data
+		res.Supported()
+		res.Bool()
+		res.Int()
+		res.Int64()
+		res.Float64()
+		res.Interface()
+
+		if !bytes.Equal(res.Data, want) {
+			t.Fatalf("%s: Data was altered (got %d bytes, want %d)", key, len(res.Data), len(want))
+		}
+
+		if res.String() != string(want) {
+			t.Fatalf("%s: String() doesn't match Data", key)
+		}
+
+		if res.IsText() {
+			t.Fatalf("%s: IsText() should be false for binary data", key)
+		}
+	}
+}
+
+func TestToResult(t *testing.T) {
+	at := time.Unix(1700000000, 123)
+	res := &Response{Data: []byte("6.0.21"), ReceivedAt: at}
+
+	result := res.ToResult("web01:10050", "agent.version")
+	want := ResultProto{Host: "web01:10050", Key: "agent.version", Value: []byte("6.0.21"), Supported: true, ReceivedUnixNano: at.UnixNano()}
+	if !reflect.DeepEqual(result, want) {
+		t.Fatalf("Expected %+v, got %+v", want, result)
+	}
+
+	res.Data[0] = '7'
+	if string(result.Value) != "6.0.21" {
+		t.Fatal("Value should be a copy of Data")
+	}
+
+	res = &Response{Data: []byte("ZBX_NOTSUPPORTED\x00Unsupported item key.")}
+	result = res.ToResult("web01:10050", "no.such.key")
+	if result.Supported || result.Value != nil || result.Error != "Unsupported item key." || result.ReceivedUnixNano != 0 {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+
+	res = &Response{Data: []byte("ZBX_NOTSUPPORTED")}
+	if result := res.ToResult("", "no.such.key"); result.Error != "no.such.key is not supported" {
+		t.Fatal("Expected an error without a reason, got:", result.Error)
+	}
+}
+
+func TestSupported(t *testing.T) {
+	tests := []struct {
+		data      string
+		supported bool
+	}{
+		{NotSupported, false},
+		{NotSupported + "\x00Unsupported item key.", false},
+		{"log line mentioning " + NotSupported, true},
+		{"ZBX_NOTSUPP", true},
+		{"", true},
+	}
+
+	for _, test := range tests {
+		res := &Response{Data: []byte(test.data)}
+		if res.Supported() != test.supported {
+			t.Errorf("%q: expected Supported() %v", test.data, test.supported)
+		}
+	}
+
+	res := &Response{Data: []byte(NotSupported + "\x00reason")}
+	if allocs := testing.AllocsPerRun(100, func() { res.Supported() }); allocs > 0 {
+		t.Fatal("Expected no allocations, got:", allocs)
+	}
+}
+
+func TestDataAsFloat64WithRaw(t *testing.T) {
+	f, raw, err := (&Response{Data: []byte(" 0.25\n")}).DataAsFloat64WithRaw()
+	if err != nil || f != 0.25 || raw != "0.25" {
+		t.Fatal("Unexpected result:", f, raw, err)
+	}
+
+	_, raw, err = (&Response{Data: []byte("Linux web01\n")}).DataAsFloat64WithRaw()
+	if err == nil || raw != "Linux web01" {
+		t.Fatal("Expected an error with the raw value, got:", raw, err)
+	}
+}
+
+func TestIsText(t *testing.T) {
+	res := &Response{Data: []byte("héllo wörld\n")}
+	if !res.IsText() {
+		t.Fatal("UTF-8 text should be reported as text")
+	}
+
+	res.Data = nil
+	if !res.IsText() {
+		t.Fatal("Empty data should be reported as text")
+	}
+}
+
+func TestParseResponseLength(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 300)
+
+	// Anything after DataLength bytes isn't part of the response
+	res, err := ParseResponse(bytes.NewReader(append(encodeFrame(data), "trailing"...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.DataLength != 300 || !bytes.Equal(res.Data, data) {
+		t.Fatalf("Expected 300 bytes, got DataLength %d and %d bytes", res.DataLength, len(res.Data))
+	}
+}
+
+func TestQueryLargeFrame(t *testing.T) {
+	data := bytes.Repeat([]byte("large"), 1000)
+	agent := agentFor(newRawServer(t, func(conn net.Conn) {
+		conn.Read(make([]byte, 512))
+
+		// 8 byte data length and reserved fields instead of 4
+		frame := []byte("ZBXD\x05")
+		frame = binary.LittleEndian.AppendUint64(frame, uint64(len(data)))
+		frame = binary.LittleEndian.AppendUint64(frame, 0)
+		conn.Write(append(frame, data...))
+	}))
+
+	res, err := agent.Query("vfs.file.contents[/var/log/big]", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Header[4] != FlagProtocol|FlagLarge || res.DataLength != uint64(len(data)) || !bytes.Equal(res.Data, data) {
+		t.Fatalf("Large frame wasn't read correctly: header %q, %d bytes", res.Header, len(res.Data))
+	}
+}
+
+func TestResponseFromBytes(t *testing.T) {
+	// Replies laid out byte for byte as each agent version sends them
+	tests := []struct {
+		version string
+		frame   string
+		data    string
+	}{
+		{"4.0 agentd", "ZBXD\x01\x01\x00\x00\x00\x00\x00\x00\x001", "1"},
+		{"4.4 agentd", "ZBXD\x01\x26\x00\x00\x00\x00\x00\x00\x00ZBX_NOTSUPPORTED\x00Unsupported item key.", "ZBX_NOTSUPPORTED\x00Unsupported item key."},
+		{"5.0 agent2", "ZBXD\x01\x05\x00\x00\x00\x00\x00\x00\x005.0.1", "5.0.1"},
+		{"6.0 agent2", "ZBXD\x01\x06\x00\x00\x00\x00\x00\x00\x00web-01", "web-01"},
+		{"7.0 agent2", "ZBXD\x01\x2a\x00\x00\x00\x00\x00\x00\x00{\"version\":\"7.0.0\",\"data\":[{\"value\":\"1\"}]}", `{"version":"7.0.0","data":[{"value":"1"}]}`},
+	}
+
+	for _, test := range tests {
+		res, err := ResponseFromBytes([]byte(test.frame))
+		if err != nil {
+			t.Errorf("%s: %v", test.version, err)
+			continue
+		}
+		if res.String() != test.data || res.DataLength != uint64(len(test.data)) {
+			t.Errorf("%s: expected %q, got %q", test.version, test.data, res.Data)
+		}
+	}
+
+	if _, err := ResponseFromBytes([]byte("ZBXD\x01\x05\x00\x00\x00\x00\x00\x00\x005.0")); err != ErrTruncatedResponse {
+		t.Error("Expected ErrTruncatedResponse, got:", err)
+	}
+}
+
+func TestDataUnescaped(t *testing.T) {
+	tests := []struct {
+		data, want string
+	}{
+		{`"say \"hi\""`, `say "hi"`},
+		{`"/mnt/[a,b]"`, `/mnt/[a,b]`},
+		{`"C:\\logs\\app.log"`, `C:\\logs\\app.log`},
+		{`""`, ``},
+		{`plain [value]`, `plain [value]`},
+		{`"unterminated`, `"unterminated`},
+		{`"`, `"`},
+	}
+
+	for _, test := range tests {
+		res := &Response{Data: []byte(test.data)}
+		if got := res.DataUnescaped(); got != test.want {
+			t.Errorf("%s: expected %s, got %s", test.data, test.want, got)
+		}
+	}
+
+	// DataUnescaped reverses BuildKey's quoting
+	for _, param := range []string{`a "quoted" [value], with commas`, ` leading space`} {
+		key := BuildKey("x", param)
+		res := &Response{Data: []byte(key[2 : len(key)-1])}
+		if got := res.DataUnescaped(); got != param {
+			t.Errorf("%s: expected %s, got %s", key, param, got)
+		}
+	}
+}
+
+func TestBOM(t *testing.T) {
+	res := &Response{Data: []byte("\xef\xbb\xbf42")}
+
+	if i, err := res.Int(); err != nil || i != 42 {
+		t.Error("Expected 42, got:", i, err)
+	}
+	if f, raw, err := res.DataAsFloat64WithRaw(); err != nil || f != 42 || raw != "42" {
+		t.Error("Expected 42, got:", f, raw, err)
+	}
+	if v := res.Interface(); v != int64(42) {
+		t.Errorf("Expected int64 42, got %#v", v)
+	}
+	if v, kind := inferValue(res.Data); v != int64(42) || kind != KindInteger {
+		t.Errorf("Expected integer 42, got %v %#v", kind, v)
+	}
+
+	if res.String() != "\xef\xbb\xbf42" || len(res.Data) != 5 {
+		t.Error("Data should be kept raw")
+	}
+}
+
+func TestUnsupportedFunc(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"custom.empty": "",
+		"custom.value": "42",
+	}).agent()
+
+	res, err := agent.Query("custom.empty", time.Second)
+	if err != nil || !res.Supported() {
+		t.Fatal("An empty value is supported by default, got:", res, err)
+	}
+
+	agent.UnsupportedFunc = func(data []byte) bool {
+		return len(data) == 0 || bytes.HasPrefix(data, []byte(NotSupported))
+	}
+
+	res, err = agent.Query("custom.empty", time.Second)
+	if err != nil || res.Supported() {
+		t.Fatal("Expected the empty value to be unsupported, got:", res, err)
+	}
+
+	var nsErr *NotSupportedError
+	if _, err := agent.GetBytes("custom.empty", time.Second); !errors.As(err, &nsErr) || nsErr.Key != "custom.empty" {
+		t.Fatal("Expected a NotSupportedError, got:", err)
+	}
+	if data, err := agent.GetBytes("custom.value", time.Second); err != nil || string(data) != "42" {
+		t.Fatal("Expected 42, got:", string(data), err)
+	}
+	if _, err := agent.GetBytes("no.such.key", time.Second); !errors.As(err, &nsErr) {
+		t.Fatal("Expected a NotSupportedError, got:", err)
+	}
+}
+
+func TestDataAsStringNoCopy(t *testing.T) {
+	for _, data := range [][]byte{nil, {}, []byte("ZBX_NOTSUPPORTED\x00reason")} {
+		res := &Response{Data: data}
+		if res.DataAsStringNoCopy() != res.String() {
+			t.Errorf("Expected %q, got %q", res.String(), res.DataAsStringNoCopy())
+		}
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		res := &Response{Data: []byte("1")}
+		_ = res.DataAsStringNoCopy() == "1"
+	})
+	if allocs > 0 {
+		t.Fatal("Expected no allocations, got:", allocs)
+	}
+}
+
+func BenchmarkDataAsStringNoCopy(b *testing.B) {
+	res := &Response{Data: bytes.Repeat([]byte("x"), 4096)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if res.DataAsStringNoCopy() == "" {
+			b.Fatal("Unexpected empty string")
+		}
+	}
+}
+
+func TestReceivedAt(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "1"}).agent()
+
+	before := time.Now()
+	res, err := agent.Query("agent.ping", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.ReceivedAt.Before(before) || time.Since(res.ReceivedAt) > time.Second {
+		t.Fatal("ReceivedAt isn't close to now:", res.ReceivedAt)
+	}
+}
+
+func TestTruncatedResponse(t *testing.T) {
+	frame := encodeFrame(bytes.Repeat([]byte("x"), 100))
+
+	for _, n := range []int{3, 9, 50} {
+		_, err := ParseResponse(bytes.NewReader(frame[:n]))
+		if err != ErrTruncatedResponse {
+			t.Errorf("%d bytes: expected ErrTruncatedResponse, got %v", n, err)
+		}
+	}
+}
+
+func TestConnectionReset(t *testing.T) {
+	frame := encodeFrame(bytes.Repeat([]byte("x"), 100))
+
+	ln := newRawServer(t, func(conn net.Conn) {
+		conn.Read(make([]byte, 512))
+		conn.Write(frame[:50])
+
+		// Give the client time to block reading the rest, then reset
+		time.Sleep(50 * time.Millisecond)
+		conn.(*net.TCPConn).SetLinger(0)
+	})
+
+	_, err := agentFor(ln).Query("agent.ping", time.Second)
+	if !errors.Is(err, ErrConnectionReset) {
+		t.Fatal("Expected ErrConnectionReset, got:", err)
+	}
+}
+
+func TestMaxDataLength(t *testing.T) {
+	ln := newRawServer(t, func(conn net.Conn) {
+		conn.Read(make([]byte, 512))
+		conn.Write([]byte("ZBXD\x05\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"))
+		conn.Write(bytes.Repeat([]byte("x"), 64<<10))
+	})
+
+	agent := agentFor(ln)
+	agent.MaxDataLength = 1 << 20
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := agent.Query("vfs.file.contents[/dev/zero]", time.Second)
+	runtime.ReadMemStats(&after)
+
+	if err != ErrResponseTooLarge {
+		t.Fatal("Expected ErrResponseTooLarge, got:", err)
+	}
+
+	// The declared 1TB must not have been allocated, even briefly
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatal("Rejecting the response allocated", allocated, "bytes")
+	}
+}
+
+func TestTimings(t *testing.T) {
+	agent := agentFor(newRawServer(t, func(conn net.Conn) {
+		conn.Read(make([]byte, 512))
+		frame := encodeFrame([]byte("1"))
+
+		// The agent takes a while to compute the value and then trickles it
+		time.Sleep(100 * time.Millisecond)
+		conn.Write(frame[:5])
+		time.Sleep(50 * time.Millisecond)
+		conn.Write(frame[5:])
+	}))
+
+	res, err := agent.Query("agent.ping", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm := res.Timings
+	if tm.Dial <= 0 || tm.Dial > 50*time.Millisecond {
+		t.Error("Unexpected dial time:", tm.Dial)
+	}
+	if tm.TimeToFirstByte < 100*time.Millisecond || tm.TimeToFirstByte > 150*time.Millisecond {
+		t.Error("Unexpected time to first byte:", tm.TimeToFirstByte)
+	}
+	if tm.Read < 50*time.Millisecond || tm.Read > 100*time.Millisecond {
+		t.Error("Unexpected read time:", tm.Read)
+	}
+	if tm.Total() < 150*time.Millisecond {
+		t.Error("Unexpected total:", tm.Total())
+	}
+}
@@ -0,0 +1,100 @@
+package zagent
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// Returned by Agent.Run unless Agent.AllowRemoteCommands is set.
+var ErrRemoteCommandsDisabled = errors.New("remote commands are disabled on this Agent")
+
+// Returned by Agent.Run for commands the agent's key syntax can't carry.
+var ErrInvalidCommand = errors.New("command can't be passed in an item key")
+
+// RunMode is how system.run executes a command.
+type RunMode int
+
+const (
+	RunWait   RunMode = iota // Wait for the command and return its output
+	RunNoWait                // Start the command in the background and return at once
+)
+
+func (m RunMode) String() string {
+	if m == RunNoWait {
+		return "nowait"
+	}
+	return "wait"
+}
+
+// RunOptions controls how Agent.Run executes a command.
+type RunOptions struct {
+	Mode RunMode
+}
+
+// RunResult is the outcome of a system.run command.
+type RunResult struct {
+	Mode RunMode
+
+	// The command's output for RunWait, trailing new lines removed as the
+	// agent does. Always empty for RunNoWait.
+	Output string
+
+	// True if the agent acknowledged starting a RunNoWait command. Nothing
+	// is known about whether the command itself succeeded.
+	Started bool
+}
+
+/*
+	Execute command on the agent with system.run. The agent must have
+	EnableRemoteCommands=1 (AllowKey=system.run[*] on agent 2) and the
+	Agent must have AllowRemoteCommands set, otherwise
+	ErrRemoteCommandsDisabled is returned without connecting.
+
+	The agent kills commands that run longer than its own Timeout setting
+	(3 seconds by default) and replies ZBX_NOTSUPPORTED, so a context
+	deadline longer than that doesn't let a RunWait command run longer.
+	Use RunNoWait for anything slow. Refusals and timeouts on the agent's
+	side are returned as a *NotSupportedError.
+*/
+func (a *Agent) Run(ctx context.Context, command string, opts RunOptions) (*RunResult, error) {
+	if !a.AllowRemoteCommands {
+		return nil, ErrRemoteCommandsDisabled
+	}
+
+	key, err := runKey(command, opts.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := a.QueryContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := res.notSupportedError(key); err != nil {
+		return nil, err
+	}
+
+	result := &RunResult{Mode: opts.Mode}
+	if opts.Mode == RunNoWait {
+		result.Started = res.String() == "1"
+	} else {
+		result.Output = res.String()
+	}
+
+	return result, nil
+}
+
+/*
+	Build the system.run key for command. The command is always quoted so
+	commas, brackets and spaces reach the shell untouched. Zabbix has no
+	way to escape a backslash so commands ending with one are rejected.
+*/
+func runKey(command string, mode RunMode) (string, error) {
+	if command == "" || strings.HasSuffix(command, `\`) {
+		return "", ErrInvalidCommand
+	}
+
+	quoted := `"` + strings.Replace(command, `"`, `\"`, -1) + `"`
+	return "system.run[" + quoted + "," + mode.String() + "]", nil
+}
@@ -0,0 +1,72 @@
+package zagent
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRunKey(t *testing.T) {
+	tests := []struct {
+		command string
+		mode    RunMode
+		key     string
+	}{
+		{"uptime", RunWait, `system.run["uptime",wait]`},
+		{`echo "a,b" [c]`, RunWait, `system.run["echo \"a,b\" [c]",wait]`},
+		{"systemctl restart nginx", RunNoWait, `system.run["systemctl restart nginx",nowait]`},
+	}
+
+	for _, test := range tests {
+		key, err := runKey(test.command, test.mode)
+		if err != nil || key != test.key {
+			t.Errorf("%q: expected %s, got %s (%v)", test.command, test.key, key, err)
+		}
+	}
+
+	for _, command := range []string{"", `echo \`} {
+		if _, err := runKey(command, RunWait); !errors.Is(err, ErrInvalidCommand) {
+			t.Errorf("%q: expected ErrInvalidCommand, got %v", command, err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		`system.run["hostname -s",wait]`:   "web01",
+		`system.run["hostname -s",nowait]`: "1",
+		`system.run["sleep 10",wait]`:      NotSupported + "\x00Timeout while executing a shell script.",
+	})
+	agent := fake.agent()
+
+	if _, err := agent.Run(context.Background(), "hostname -s", RunOptions{}); err != ErrRemoteCommandsDisabled {
+		t.Fatal("Expected ErrRemoteCommandsDisabled, got:", err)
+	}
+	if len(fake.received()) != 0 {
+		t.Fatal("Expected no connection while remote commands are disabled")
+	}
+
+	agent.AllowRemoteCommands = true
+
+	res, err := agent.Run(context.Background(), "hostname -s", RunOptions{Mode: RunWait})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Output != "web01" || res.Started {
+		t.Fatalf("Unexpected result: %+v", res)
+	}
+
+	res, err = agent.Run(context.Background(), "hostname -s", RunOptions{Mode: RunNoWait})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Output != "" || !res.Started {
+		t.Fatalf("Unexpected result: %+v", res)
+	}
+
+	_, err = agent.Run(context.Background(), "sleep 10", RunOptions{})
+	var nsErr *NotSupportedError
+	if !errors.As(err, &nsErr) || nsErr.Reason != "Timeout while executing a shell script." {
+		t.Fatal("Expected a NotSupportedError with the agent's reason, got:", err)
+	}
+}
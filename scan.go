@@ -0,0 +1,158 @@
+package zagent
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Service is the kind of service Scan found listening on a port.
+type Service int
+
+const (
+	ServiceClosed   Service = iota // Nothing accepted the connection
+	ServiceAgent                   // A zabbix agent that answered our query
+	ServiceRejected                // A zabbix agent that closed the connection on us (Server= mismatch)
+	ServiceTLS                     // Something that requires a TLS handshake, e.g. an encrypted agent
+	ServiceUnknown                 // Something that isn't a zabbix agent
+)
+
+func (s Service) String() string {
+	switch s {
+	case ServiceClosed:
+		return "closed"
+	case ServiceAgent:
+		return "agent"
+	case ServiceRejected:
+		return "rejected"
+	case ServiceTLS:
+		return "tls"
+	}
+	return "unknown"
+}
+
+// ScanOptions controls how Scan probes targets.
+type ScanOptions struct {
+	Concurrency int           // Maximum number of probes in flight. Defaults to 64.
+	Timeout     time.Duration // Timeout for each probe. Defaults to 2 seconds.
+}
+
+// ScanResult is the fingerprint of a single host and port.
+type ScanResult struct {
+	Host     string
+	Port     int
+	Service  Service
+	Version  string  // agent.version, only set for ServiceAgent
+	Hostname string  // agent.hostname, only set for ServiceAgent
+	Variant  Variant // agentd or agent2, only set for ServiceAgent
+	Err      error   // The error that led to the classification, if any
+}
+
+/*
+	Probe every port on every target and classify what's listening. Probes
+	run concurrently and the results are returned in target then port order.
+	If the context is cancelled the remaining probes are skipped and the
+	context's error is returned along with the results gathered so far.
+*/
+func Scan(ctx context.Context, targets []string, ports []int, opts ScanOptions) ([]ScanResult, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 64
+	}
+	if opts.Timeout < 1 {
+		opts.Timeout = 2 * time.Second
+	}
+
+	results := make([]ScanResult, 0, len(targets)*len(ports))
+	for _, host := range targets {
+		for _, port := range ports {
+			results = append(results, ScanResult{Host: host, Port: port})
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.Concurrency)
+
+loop:
+	for i := range results {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break loop
+		}
+
+		wg.Add(1)
+		go func(r *ScanResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fingerprint(ctx, r, opts.Timeout)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	return results, ctx.Err()
+}
+
+// Fill in the Service (and agent details) of r.
+func fingerprint(ctx context.Context, r *ScanResult, timeout time.Duration) {
+	agent := &Agent{Host: r.Host, Port: r.Port}
+
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	res, err := agent.QueryContext(probeCtx, "agent.version")
+	cancel()
+
+	var opErr *net.OpError
+	switch {
+	case err == nil:
+		r.Service = ServiceAgent
+		r.Version = res.String()
+	case errors.Is(err, ErrTLSRequired):
+		r.Service = ServiceTLS
+	case errors.Is(err, ErrEmptyResponse):
+		r.Service = ServiceRejected
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		r.Service = ServiceClosed
+	default:
+		r.Service = ServiceUnknown
+	}
+	r.Err = err
+
+	if r.Service == ServiceAgent {
+		probeCtx, cancel := context.WithTimeout(ctx, timeout)
+		if res, err := agent.QueryContext(probeCtx, "agent.hostname"); err == nil {
+			r.Hostname = res.String()
+		}
+		cancel()
+
+		probeCtx, cancel = context.WithTimeout(ctx, timeout)
+		r.Variant, _ = agent.Variant(probeCtx)
+		cancel()
+	}
+}
+
+/*
+	Returns true if the service at the agent's address speaks TLS. Getting
+	a TLS alert back counts since encrypted agents abort handshakes without
+	the right PSK or client certificate.
+*/
+func probeTLS(ctx context.Context, agent *Agent, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := agent.dial(ctx, "tcp")
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	err = tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+
+	var alert tls.AlertError
+	return err == nil || errors.As(err, &alert)
+}
@@ -0,0 +1,105 @@
+package zagent
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Split an address returned by a listener into host and port.
+func splitAddr(t *testing.T, addr string) (string, int) {
+	host, portS, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, _ := strconv.Atoi(portS)
+	return host, port
+}
+
+// Start a server that writes banner to every connection and closes it.
+func newBannerServer(t *testing.T, banner string) net.Listener {
+	return newRawServer(t, func(conn net.Conn) {
+		if banner != "" {
+			// Drain the query so closing doesn't reset the connection
+			io.WriteString(conn, banner)
+			conn.Read(make([]byte, 512))
+		}
+	})
+}
+
+func TestScan(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"agent.version":  "6.0.21",
+		"agent.hostname": "web01",
+		"agent.variant":  "2",
+	})
+
+	// An agent that rejects us closes the connection straight away
+	rejecting := newBannerServer(t, "")
+
+	// Something else, e.g. ssh, that sends its own banner
+	ssh := newBannerServer(t, "SSH-2.0-OpenSSH_9.6\r\n")
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	encrypted := httptest.NewUnstartedServer(handler)
+	encrypted.Config.ErrorLog = log.New(io.Discard, "", 0)
+	encrypted.StartTLS()
+	defer encrypted.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	want := map[string]Service{
+		agent.ln.Addr().String():           ServiceAgent,
+		rejecting.Addr().String():          ServiceRejected,
+		encrypted.Listener.Addr().String(): ServiceTLS,
+		ssh.Addr().String():                ServiceUnknown,
+		closed.Addr().String():             ServiceClosed,
+	}
+
+	ports := []int{}
+	for addr := range want {
+		_, port := splitAddr(t, addr)
+		ports = append(ports, port)
+	}
+
+	results, err := Scan(context.Background(), []string{"127.0.0.1"}, ports, ScanOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != len(want) {
+		t.Fatalf("Expected %d results, got %d", len(want), len(results))
+	}
+
+	for _, r := range results {
+		addr := net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+		if r.Service != want[addr] {
+			t.Errorf("%s: expected %v, got %v (%v)", addr, want[addr], r.Service, r.Err)
+		}
+
+		if r.Service == ServiceAgent && (r.Version != "6.0.21" || r.Hostname != "web01" || r.Variant != VariantAgent2) {
+			t.Errorf("%s: unexpected agent details %+v", addr, r)
+		}
+	}
+}
+
+func TestScanCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := Scan(ctx, []string{"127.0.0.1"}, []int{1, 2, 3}, ScanOptions{Concurrency: 1})
+	if err != context.Canceled {
+		t.Fatal("Expected context.Canceled, got:", err)
+	}
+}
@@ -0,0 +1,216 @@
+package zagent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+	Returned by Session.Query after the session was closed, or once the
+	agent closed the connection of a session accepted by Listen.
+*/
+var ErrSessionClosed = errors.New("session closed")
+
+/*
+	Session is a connection to an agent that's reused for as many keys as
+	the agent allows. agent2 keeps connections open while classic passive
+	agents close them after answering a single key, in which case the
+	session dials again. A Session must not be used concurrently.
+*/
+type Session struct {
+	// Connections open for longer than this are closed and dialed again
+	// before sending a key rather than risking a load balancer or firewall
+	// having silently dropped them. Zero means no limit. Ignored for
+	// sessions accepted by Listen, which can't dial.
+	MaxConnAge time.Duration
+
+	agent    *Agent
+	conn     net.Conn
+	dialedAt time.Time
+
+	used    bool // True once a key has been sent over conn
+	closed  bool // conn is known to be closed, by us or the agent
+	shut    bool // Close was called
+	inbound bool // Accepted by Listen, so it can't dial again
+
+	dialTime time.Duration // How long dialing conn took, until the first key is sent
+	framing  FramingMode   // How keys are sent, chosen before the first dial
+}
+
+// Open a Session to the agent, verifying its hostname first if ExpectedHostname is set.
+func (a *Agent) Dial(timeout time.Duration) (*Session, error) {
+	err := a.verifyHostname(func() (*Response, error) {
+		return a.roundTrip("tcp", "agent.hostname", timeout)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout(timeout))
+	defer cancel()
+
+	// FramingAuto's probe needs its own connection, so it can't overlap ours
+	mode, err := a.framing(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	conn, err := a.dial(ctx, "tcp")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{agent: a, conn: conn, dialedAt: start, dialTime: time.Since(start), framing: mode}, nil
+}
+
+/*
+	Accept connections from agents that dial out to addr, for networks
+	where agents can't be dialed, and call handler with a Session for each
+	in its own goroutine. The connection is closed when handler returns.
+	The returned Closer is the net.Listener, closing it stops accepting.
+*/
+func Listen(addr string, handler func(*Session)) (io.Closer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				handler(&Session{agent: agentFromConn(conn), conn: conn, inbound: true})
+			}()
+		}
+	}()
+
+	return ln, nil
+}
+
+// Returns an Agent for the remote end of an inbound connection.
+func agentFromConn(conn net.Conn) *Agent {
+	host, portS, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	port, _ := strconv.Atoi(portS)
+	return &Agent{Host: host, Port: port}
+}
+
+/*
+	Run the check (key) over the session's connection. If timeout is < 1
+	Agent.Timeout or DefaultTimeout will be used. The connection is dialed
+	again if the agent closed it, including when it closes the connection
+	without answering a reused connection, or once it's older than
+	MaxConnAge. The connection is dropped after
+	any other error so the next key starts afresh.
+*/
+func (s *Session) Query(key string, timeout time.Duration) (*Response, error) {
+	if s.shut {
+		return nil, ErrSessionClosed
+	}
+	if err := s.agent.checkKeyAllowed(key); err != nil {
+		return nil, err
+	}
+	timeout = s.agent.timeout(timeout)
+
+	// agentd closes the connection after every key so don't bother trying
+	if s.closed || s.used && s.agent.knownVariant() == VariantAgentd || s.tooOld() {
+		if err := s.redial(timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	reused := s.used
+	res, err := s.exchange(key, timeout)
+	if reused && closedByAgent(err) && !s.inbound {
+		if err := s.redial(timeout); err != nil {
+			return nil, err
+		}
+		res, err = s.exchange(key, timeout)
+	}
+
+	return res, err
+}
+
+// Send key over the current connection, closing it on errors.
+func (s *Session) exchange(key string, timeout time.Duration) (*Response, error) {
+	s.used = true
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	s.conn.SetDeadline(deadline)
+
+	res, err := s.agent.exchange(ctx, s.conn, key, s.framing, s.dialTime)
+	s.dialTime = 0
+	if err != nil {
+		s.conn.Close()
+		s.closed = true
+	}
+
+	return res, err
+}
+
+// Returns true if err means the agent had closed the connection before we sent a key.
+func closedByAgent(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, ErrEmptyResponse) || errors.As(err, &opErr) && opErr.Op == "write"
+}
+
+// Replace the connection with a new one, unless the session can't dial.
+func (s *Session) redial(timeout time.Duration) error {
+	if s.shut || s.inbound {
+		return ErrSessionClosed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := s.agent.dial(ctx, "tcp")
+	if err != nil {
+		return err
+	}
+
+	s.conn.Close()
+	s.conn, s.used, s.closed = conn, false, false
+	s.dialedAt, s.dialTime = start, time.Since(start)
+	return nil
+}
+
+// Returns true if the connection is older than MaxConnAge and can be replaced.
+func (s *Session) tooOld() bool {
+	return s.MaxConnAge > 0 && !s.inbound && time.Since(s.dialedAt) >= s.MaxConnAge
+}
+
+/*
+	Returns true if the session's connection is known to be closed, either
+	by Close or because a query found the agent had closed it. The next
+	query dials again unless Close was called.
+*/
+func (s *Session) Closed() bool {
+	return s.closed || s.shut
+}
+
+// Returns the local address of the session's connection.
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Returns the agent's address.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Close the session's connection.
+func (s *Session) Close() error {
+	s.shut = true
+	return s.conn.Close()
+}
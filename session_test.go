@@ -0,0 +1,180 @@
+package zagent
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "1"})
+
+	session, err := fake.agent().Dial(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	if session.RemoteAddr().String() != fake.ln.Addr().String() {
+		t.Fatalf("Expected remote address %v, got %v", fake.ln.Addr(), session.RemoteAddr())
+	}
+
+	if session.LocalAddr() == nil || session.LocalAddr().String() == session.RemoteAddr().String() {
+		t.Fatal("Unexpected local address:", session.LocalAddr())
+	}
+
+	res, err := session.Query("agent.ping", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.String() != "1" {
+		t.Fatal("Unexpected response:", res.String())
+	}
+}
+
+func TestListen(t *testing.T) {
+	values := make(chan string, 1)
+	ln, err := Listen("127.0.0.1:0", func(s *Session) {
+		res, err := s.Query("agent.hostname", time.Second)
+		if err != nil {
+			values <- err.Error()
+			return
+		}
+		values <- res.String()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// The agent dials in and answers the key it's sent
+	conn, err := net.Dial("tcp", ln.(net.Listener).Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := string(bytes.TrimRight(buf[:n], "\n")); key != "agent.hostname" {
+		t.Fatal("Unexpected key:", key)
+	}
+	conn.Write(encodeFrame([]byte("dmz01")))
+
+	if value := <-values; value != "dmz01" {
+		t.Fatal("Unexpected value:", value)
+	}
+}
+
+// Start an agent that answers any number of keys per connection and counts connections.
+func newKeepAliveServer(t *testing.T, dials *int32) net.Listener {
+	return newRawServer(t, func(conn net.Conn) {
+		atomic.AddInt32(dials, 1)
+		buf := make([]byte, 512)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			conn.Write(encodeFrame(bytes.TrimRight(buf[:n], "\n")))
+		}
+	})
+}
+
+func TestSessionReuse(t *testing.T) {
+	var dials int32
+	session, err := agentFor(newKeepAliveServer(t, &dials)).Dial(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("key.%d", i)
+		res, err := session.Query(key, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.String() != key {
+			t.Fatalf("Expected %s, got %s", key, res.String())
+		}
+	}
+
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatal("Expected a single connection, got:", n)
+	}
+	if session.Closed() {
+		t.Fatal("Session shouldn't be closed")
+	}
+
+	session.Close()
+	if !session.Closed() {
+		t.Fatal("Session should be closed")
+	}
+	if _, err := session.Query("key.0", time.Second); err != ErrSessionClosed {
+		t.Fatal("Expected ErrSessionClosed, got:", err)
+	}
+}
+
+func TestSessionMaxConnAge(t *testing.T) {
+	var dials int32
+	session, err := agentFor(newKeepAliveServer(t, &dials)).Dial(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	session.MaxConnAge = 100 * time.Millisecond
+
+	query := func() {
+		t.Helper()
+		if _, err := session.Query("agent.ping", time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query()
+	query()
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatal("Expected a young connection to be reused, got connections:", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	query()
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatal("Expected an old connection to be replaced, got connections:", n)
+	}
+
+	// The age restarts with the new connection
+	query()
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatal("Expected the new connection to be reused, got connections:", n)
+	}
+}
+
+func TestSessionRedial(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "1"})
+
+	session, err := fake.agent().Dial(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	// The fake agent closes the connection after every key, like agentd
+	for i := 0; i < 3; i++ {
+		if _, err := session.Query("agent.ping", time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if keys := fake.received(); len(keys) != 3 {
+		t.Fatal("Expected each key to be received once, got:", keys)
+	}
+}
@@ -0,0 +1,311 @@
+package zagent
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AgentSet is a group of agents that can be selected by label and queried together.
+type AgentSet struct {
+	agents []*Agent
+
+	// Maximum queries in flight for QueryAll and PingAll, unlimited if < 1.
+	Concurrency int
+}
+
+// SetResult is the result of querying one agent of an AgentSet.
+type SetResult struct {
+	Agent    *Agent
+	Labels   map[string]string // A copy of Agent.Labels
+	Response *Response
+	Err      error
+}
+
+// PingReportEntry is one agent's line in a PingReport.
+type PingReportEntry struct {
+	Host      string // The agent's address as host:port
+	Reachable bool
+	RTT       time.Duration
+	Err       error
+}
+
+// AggStats summarises a numeric key across agents.
+type AggStats struct {
+	Min, Max, Sum, Avg float64
+	Count              int              // Agents that returned a number
+	Errors             map[string]error // By host:port, for agents that didn't
+}
+
+// PingResult is the result of pinging one agent of an AgentSet.
+type PingResult struct {
+	Agent  *Agent
+	Labels map[string]string // A copy of Agent.Labels
+	Alive  bool
+	Err    error
+}
+
+// Creates a new AgentSet, ignoring duplicate agents.
+func NewAgentSet(agents ...*Agent) *AgentSet {
+	s := &AgentSet{}
+	for _, agent := range agents {
+		if !s.Contains(agent) {
+			s.agents = append(s.agents, agent)
+		}
+	}
+	return s
+}
+
+// Returns the agents in the set.
+func (s *AgentSet) Agents() []*Agent {
+	return append([]*Agent(nil), s.agents...)
+}
+
+// Returns the number of agents in the set.
+func (s *AgentSet) Len() int {
+	return len(s.agents)
+}
+
+// Returns true if agent is in the set.
+func (s *AgentSet) Contains(agent *Agent) bool {
+	for _, a := range s.agents {
+		if a == agent {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Returns the agents whose labels match selector, a comma separated list
+	of key=value and key!=value requirements, e.g. "role=db,site!=us-east".
+	A != requirement matches agents without the label. An empty selector
+	matches every agent.
+*/
+func (s *AgentSet) Select(selector string) (*AgentSet, error) {
+	reqs, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	subset := &AgentSet{Concurrency: s.Concurrency}
+	for _, agent := range s.agents {
+		if reqs.matches(agent.Labels) {
+			subset.agents = append(subset.agents, agent)
+		}
+	}
+
+	return subset, nil
+}
+
+// Returns the agents in either set.
+func (s *AgentSet) Union(other *AgentSet) *AgentSet {
+	union := NewAgentSet(append(s.Agents(), other.agents...)...)
+	union.Concurrency = s.Concurrency
+	return union
+}
+
+// Returns the agents in both sets.
+func (s *AgentSet) Intersect(other *AgentSet) *AgentSet {
+	intersection := &AgentSet{Concurrency: s.Concurrency}
+	for _, agent := range s.agents {
+		if other.Contains(agent) {
+			intersection.agents = append(intersection.agents, agent)
+		}
+	}
+	return intersection
+}
+
+// Query the key on every agent concurrently. Results are in the set's order.
+func (s *AgentSet) QueryAll(key string, timeout time.Duration) []SetResult {
+	results := make([]SetResult, len(s.agents))
+	s.each(func(i int, agent *Agent) {
+		res, err := agent.Query(key, timeout)
+		results[i] = SetResult{Agent: agent, Labels: copyLabels(agent.Labels), Response: res, Err: err}
+	})
+	return results
+}
+
+// Call agent.ping on every agent concurrently. Results are in the set's order.
+func (s *AgentSet) PingAll(timeout time.Duration) []PingResult {
+	results := make([]PingResult, len(s.agents))
+	s.each(func(i int, agent *Agent) {
+		alive, err := agent.AgentPing(timeout)
+		results[i] = PingResult{Agent: agent, Labels: copyLabels(agent.Labels), Alive: alive, Err: err}
+	})
+	return results
+}
+
+/*
+	Ping every agent, at most concurrency at once (unlimited if < 1), and
+	return the results slowest first for triaging a fleet. Unreachable
+	agents come last, in the order given.
+*/
+func PingReport(agents []*Agent, timeout time.Duration, concurrency int) []PingReportEntry {
+	entries := make([]PingReportEntry, len(agents))
+	set := &AgentSet{agents: agents, Concurrency: concurrency}
+	set.each(func(i int, agent *Agent) {
+		l, err := agent.Liveness(timeout)
+		if err == nil && !l.Reachable {
+			err = ErrPingFailed
+		}
+		entries[i] = PingReportEntry{Host: agent.String(), Reachable: l.Reachable, RTT: l.RTT, Err: err}
+	})
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Reachable != entries[j].Reachable {
+			return entries[i].Reachable
+		}
+		return entries[i].Reachable && entries[i].RTT > entries[j].RTT
+	})
+
+	return entries
+}
+
+/*
+	Query the key on every agent concurrently and compute statistics over
+	the numeric values. Failed queries, unsupported keys and values that
+	aren't numbers are recorded in Errors by host:port. An error is only
+	returned if no agent returned a number.
+*/
+func AggregateAcrossAgents(agents []*Agent, key string, timeout time.Duration) (AggStats, error) {
+	stats := AggStats{Errors: map[string]error{}}
+	var mu sync.Mutex
+
+	set := &AgentSet{agents: agents}
+	set.each(func(i int, agent *Agent) {
+		res, err := agent.Query(key, timeout)
+		if err == nil {
+			err = res.notSupportedError(key)
+		}
+
+		var v float64
+		if err == nil {
+			v, _, err = res.DataAsFloat64WithRaw()
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			stats.Errors[agent.String()] = err
+			return
+		}
+
+		if stats.Count == 0 || v < stats.Min {
+			stats.Min = v
+		}
+		if stats.Count == 0 || v > stats.Max {
+			stats.Max = v
+		}
+		stats.Sum += v
+		stats.Count++
+	})
+
+	if stats.Count == 0 {
+		return stats, fmt.Errorf("%s: no agent returned a number", key)
+	}
+	stats.Avg = stats.Sum / float64(stats.Count)
+
+	return stats, nil
+}
+
+// Returns the key agents are sharded by, their address as host:port.
+func (a *Agent) ShardKey() string {
+	return a.hostPort()
+}
+
+/*
+	Returns which of shards (numbered from 0) the agent belongs to, for
+	splitting a fleet across pollers. The hash of ShardKey is fixed so
+	every poller and every release agrees. Returns 0 if shards < 1.
+*/
+func ShardIndex(a *Agent, shards int) int {
+	if shards < 1 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(a.ShardKey()))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// Call fn for every agent, running at most Concurrency at once.
+func (s *AgentSet) each(fn func(i int, agent *Agent)) {
+	concurrency := s.Concurrency
+	if concurrency < 1 {
+		concurrency = len(s.agents)
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(concurrency, 1))
+	for i, agent := range s.agents {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, agent *Agent) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i, agent)
+		}(i, agent)
+	}
+	wg.Wait()
+}
+
+// selector is a parsed label selector.
+type selector []requirement
+
+type requirement struct {
+	key, value string
+	equal      bool
+}
+
+func parseSelector(s string) (selector, error) {
+	var sel selector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		req := requirement{equal: true}
+		var found bool
+		if req.key, req.value, found = strings.Cut(term, "!="); found {
+			req.equal = false
+		} else if req.key, req.value, found = strings.Cut(term, "=="); !found {
+			req.key, req.value, found = strings.Cut(term, "=")
+		}
+
+		req.key, req.value = strings.TrimSpace(req.key), strings.TrimSpace(req.value)
+		if !found || req.key == "" {
+			return nil, fmt.Errorf("invalid selector requirement %q", term)
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+// Returns true if labels satisfy every requirement.
+func (sel selector) matches(labels map[string]string) bool {
+	for _, req := range sel {
+		value, ok := labels[req.key]
+		if req.equal != (ok && value == req.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns a copy of labels so results don't share the agent's map.
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,212 @@
+package zagent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Returns the hosts of the agents in the set, e.g. [db1 db2].
+func setHosts(s *AgentSet) string {
+	hosts := []string{}
+	for _, agent := range s.Agents() {
+		hosts = append(hosts, agent.Host)
+	}
+	return fmt.Sprint(hosts)
+}
+
+func newLabelledSet() *AgentSet {
+	return NewAgentSet(
+		&Agent{Host: "db1", Labels: map[string]string{"role": "db", "site": "eu-west"}},
+		&Agent{Host: "db2", Labels: map[string]string{"role": "db", "site": "us-east"}},
+		&Agent{Host: "web1", Labels: map[string]string{"role": "web", "site": "eu-west"}},
+		&Agent{Host: "bare"},
+	)
+}
+
+func TestAgentSetSelect(t *testing.T) {
+	set := newLabelledSet()
+
+	tests := []struct {
+		selector string
+		hosts    string
+	}{
+		{"", "[db1 db2 web1 bare]"},
+		{"role=db", "[db1 db2]"},
+		{"role==db, site=eu-west", "[db1]"},
+		{"site!=eu-west", "[db2 bare]"},
+		{"role=cache", "[]"},
+	}
+
+	for _, test := range tests {
+		subset, err := set.Select(test.selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hosts := setHosts(subset); hosts != test.hosts {
+			t.Errorf("%q: expected %s, got %v", test.selector, test.hosts, hosts)
+		}
+	}
+
+	for _, invalid := range []string{"role", "=db", "role=db,site"} {
+		if _, err := set.Select(invalid); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestAgentSetOperations(t *testing.T) {
+	set := newLabelledSet()
+	dbs, _ := set.Select("role=db")
+	eu, _ := set.Select("site=eu-west")
+
+	if hosts := setHosts(dbs.Union(eu)); hosts != "[db1 db2 web1]" {
+		t.Fatal("Unexpected union:", hosts)
+	}
+
+	if hosts := setHosts(dbs.Intersect(eu)); hosts != "[db1]" {
+		t.Fatal("Unexpected intersection:", hosts)
+	}
+}
+
+func TestAgentSetQueryAll(t *testing.T) {
+	items := map[string]string{"agent.ping": "1"}
+	db := newFakeAgent(t, "tcp", "127.0.0.1:0", items).agent()
+	db.Labels = map[string]string{"role": "db"}
+	web := newFakeAgent(t, "tcp", "127.0.0.1:0", items).agent()
+	web.Labels = map[string]string{"role": "web"}
+
+	set := NewAgentSet(db, web)
+	set.Concurrency = 1
+
+	results := set.QueryAll("agent.ping", time.Second)
+	if len(results) != 2 || results[0].Agent != db || results[1].Labels["role"] != "web" {
+		t.Fatalf("Unexpected results: %+v", results)
+	}
+
+	for _, r := range results {
+		if r.Err != nil || r.Response.String() != "1" {
+			t.Fatalf("Unexpected result: %+v", r)
+		}
+	}
+
+	dbs, _ := set.Select("role=db")
+	pings := dbs.PingAll(time.Second)
+	if len(pings) != 1 || !pings[0].Alive || pings[0].Labels["role"] != "db" {
+		t.Fatalf("Unexpected pings: %+v", pings)
+	}
+}
+
+func TestPingReport(t *testing.T) {
+	pingAfter := func(delay time.Duration) *Agent {
+		return agentFor(newRawServer(t, func(conn net.Conn) {
+			conn.Read(make([]byte, 512))
+			time.Sleep(delay)
+			conn.Write(encodeFrame([]byte("1")))
+		}))
+	}
+
+	fast, slow, medium := pingAfter(0), pingAfter(80*time.Millisecond), pingAfter(40*time.Millisecond)
+	down := agentFor(newRawServer(t, func(conn net.Conn) {}))
+
+	report := PingReport([]*Agent{fast, down, slow, medium}, time.Second, 2)
+
+	hosts := []string{}
+	for _, e := range report {
+		hosts = append(hosts, e.Host)
+	}
+	if want := []string{slow.String(), medium.String(), fast.String(), down.String()}; !reflect.DeepEqual(hosts, want) {
+		t.Fatal("Expected", want, "got", hosts)
+	}
+
+	last := report[3]
+	if last.Reachable || last.Err == nil {
+		t.Fatalf("Unexpected entry for the unreachable agent: %+v", last)
+	}
+	if report[0].RTT < 80*time.Millisecond || report[0].Err != nil {
+		t.Fatalf("Unexpected entry for the slowest agent: %+v", report[0])
+	}
+
+	wrong := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "0"}).agent()
+	if report := PingReport([]*Agent{wrong}, time.Second, 1); !errors.Is(report[0].Err, ErrPingFailed) {
+		t.Fatal("Expected ErrPingFailed, got:", report[0].Err)
+	}
+}
+
+func TestShardIndex(t *testing.T) {
+	agent := &Agent{Host: "db1", Port: DefaultPort}
+	if agent.ShardKey() != "db1:10050" {
+		t.Fatal("Unexpected shard key:", agent.ShardKey())
+	}
+
+	// Changing the hash would reshuffle every fleet, so pin it
+	if shard := ShardIndex(agent, 16); shard != ShardIndex(&Agent{Host: "db1", Port: DefaultPort}, 16) || shard != 2 {
+		t.Fatal("Unexpected shard:", shard)
+	}
+
+	const shards, agents = 8, 4000
+	counts := make([]int, shards)
+	for i := 0; i < agents; i++ {
+		counts[ShardIndex(&Agent{Host: fmt.Sprintf("10.0.%d.%d", i/256, i%256), Port: DefaultPort}, shards)]++
+	}
+	for shard, n := range counts {
+		if n < agents/shards*8/10 || n > agents/shards*12/10 {
+			t.Fatalf("Shard %d has %d agents, expected about %d: %v", shard, n, agents/shards, counts)
+		}
+	}
+
+	if ShardIndex(agent, 0) != 0 {
+		t.Fatal("Expected shard 0 without shards")
+	}
+}
+
+func TestQueryAllOrder(t *testing.T) {
+	// Later agents answer first
+	agents := []*Agent{}
+	for i := 0; i < 5; i++ {
+		delay := time.Duration(5-i) * 20 * time.Millisecond
+		value := fmt.Sprint(i)
+		agents = append(agents, agentFor(newRawServer(t, func(conn net.Conn) {
+			conn.Read(make([]byte, 512))
+			time.Sleep(delay)
+			conn.Write(encodeFrame([]byte(value)))
+		})))
+	}
+
+	results := NewAgentSet(agents...).QueryAll("agent.hostname", time.Second)
+	for i, r := range results {
+		if r.Err != nil || r.Agent != agents[i] || r.Response.String() != fmt.Sprint(i) {
+			t.Fatalf("Result %d out of order: %+v", i, r)
+		}
+	}
+}
+
+func TestAggregateAcrossAgents(t *testing.T) {
+	agents := []*Agent{}
+	for _, value := range []string{"1.5", "4", "0.5", "10"} {
+		agents = append(agents, newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"system.cpu.load": value}).agent())
+	}
+	text := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"system.cpu.load": "n/a"}).agent()
+	unsupported := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{}).agent()
+	agents = append(agents, text, unsupported)
+
+	stats, err := AggregateAcrossAgents(agents, "system.cpu.load", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Min != 0.5 || stats.Max != 10 || stats.Sum != 16 || stats.Avg != 4 || stats.Count != 4 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	if len(stats.Errors) != 2 || stats.Errors[text.String()] == nil || stats.Errors[unsupported.String()] == nil {
+		t.Fatal("Expected errors for the text and unsupported agents, got:", stats.Errors)
+	}
+
+	if _, err := AggregateAcrossAgents([]*Agent{text}, "system.cpu.load", time.Second); err == nil {
+		t.Fatal("Expected an error without any numbers")
+	}
+}
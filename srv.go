@@ -0,0 +1,59 @@
+package zagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ErrSRVNotFound is returned by DiscoverSRV when the name doesn't exist or has no records.
+var ErrSRVNotFound = errors.New("no SRV records found")
+
+// SRVResolver looks up SRV records. It's implemented by *net.Resolver.
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+/*
+	Resolve the SRV records of name (e.g. _zabbix-agent._tcp.service.consul)
+	and return an Agent for each target, ordered by priority. Within a
+	priority the resolver's order is kept, *net.Resolver randomizes it by
+	weight. If resolver is nil net.DefaultResolver is used.
+
+	A name that doesn't exist or has no records returns an error wrapping
+	ErrSRVNotFound. Other failures return the resolver's error as is, for
+	*net.DNSError check IsTemporary to decide whether to retry.
+*/
+func DiscoverSRV(ctx context.Context, name string, resolver SRVResolver) ([]*Agent, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	_, records, err := resolver.LookupSRV(ctx, "", "", name)
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, fmt.Errorf("%s: %w: %w", name, ErrSRVNotFound, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s: %w", name, ErrSRVNotFound)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Priority < records[j].Priority
+	})
+
+	agents := make([]*Agent, len(records))
+	for i, srv := range records {
+		agents[i] = &Agent{Host: strings.TrimSuffix(srv.Target, "."), Port: int(srv.Port)}
+	}
+
+	return agents, nil
+}
@@ -0,0 +1,63 @@
+package zagent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+type fakeResolver struct {
+	records []*net.SRV
+	err     error
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return name, r.records, r.err
+}
+
+func TestDiscoverSRV(t *testing.T) {
+	resolver := &fakeResolver{records: []*net.SRV{
+		{Target: "backup.example.com.", Port: 10050, Priority: 20, Weight: 10},
+		{Target: "web01.example.com.", Port: 10050, Priority: 10, Weight: 60},
+		{Target: "web02.example.com.", Port: 10051, Priority: 10, Weight: 40},
+	}}
+
+	agents, err := DiscoverSRV(context.Background(), "_zabbix-agent._tcp.service.consul", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"web01.example.com:10050", "web02.example.com:10051", "backup.example.com:10050"}
+	if len(agents) != len(want) {
+		t.Fatal("Expected 3 agents, got", len(agents))
+	}
+
+	for i, agent := range agents {
+		if agent.hostPort() != want[i] {
+			t.Errorf("Expected %s at %d, got %s", want[i], i, agent.hostPort())
+		}
+	}
+}
+
+func TestDiscoverSRVErrors(t *testing.T) {
+	ctx := context.Background()
+	name := "_zabbix-agent._tcp.service.consul"
+
+	nxdomain := &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	if _, err := DiscoverSRV(ctx, name, &fakeResolver{err: nxdomain}); !errors.Is(err, ErrSRVNotFound) {
+		t.Fatal("Expected ErrSRVNotFound for NXDOMAIN, got:", err)
+	}
+
+	if _, err := DiscoverSRV(ctx, name, &fakeResolver{}); !errors.Is(err, ErrSRVNotFound) {
+		t.Fatal("Expected ErrSRVNotFound for an empty record set, got:", err)
+	}
+
+	timeout := &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true, IsTemporary: true}
+	_, err := DiscoverSRV(ctx, name, &fakeResolver{err: timeout})
+
+	var dnsErr *net.DNSError
+	if errors.Is(err, ErrSRVNotFound) || !errors.As(err, &dnsErr) || !dnsErr.IsTemporary {
+		t.Fatal("Expected the temporary DNS error, got:", err)
+	}
+}
@@ -0,0 +1,64 @@
+package zagent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Returned by Agent.TLSCertExpiry when the agent doesn't present a certificate.
+var ErrNoTLSCertificate = errors.New("agent didn't present a TLS certificate")
+
+/*
+	Start a TLS handshake with the agent and return when its certificate
+	expires, without sending a key. The certificate isn't verified and the
+	handshake may go on to fail, e.g. for want of a client certificate,
+	once the agent's certificate has been seen. Agents without TLS or
+	using PSK fail with an error wrapping ErrNoTLSCertificate.
+*/
+func (a *Agent) TLSCertExpiry(timeout time.Duration) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout(timeout))
+	defer cancel()
+
+	conn, err := a.dial(ctx, "tcp")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	var cert *x509.Certificate
+	var certErr error
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) > 0 {
+				cert, certErr = x509.ParseCertificate(raw[0])
+			}
+			return certErr
+		},
+	}
+
+	err = tls.Client(conn, config).Handshake()
+	switch {
+	case cert != nil:
+		return cert.NotAfter, nil
+	case certErr != nil:
+		return time.Time{}, certErr
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return time.Time{}, err
+	}
+	if err == nil {
+		return time.Time{}, ErrNoTLSCertificate
+	}
+	return time.Time{}, fmt.Errorf("%w: %w", ErrNoTLSCertificate, err)
+}
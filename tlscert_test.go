@@ -0,0 +1,99 @@
+package zagent
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTLSCertExpiry(t *testing.T) {
+	encrypted := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	encrypted.Config.ErrorLog = log.New(io.Discard, "", 0)
+	encrypted.StartTLS()
+	defer encrypted.Close()
+
+	agent := agentFor(encrypted.Listener)
+	expiry, err := agent.TLSCertExpiry(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := encrypted.Certificate().NotAfter; !expiry.Equal(want) {
+		t.Fatal("Expected", want, "got", expiry)
+	}
+
+	plain := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "1"}).agent()
+	if _, err := plain.TLSCertExpiry(time.Second); !errors.Is(err, ErrNoTLSCertificate) {
+		t.Fatal("Expected ErrNoTLSCertificate, got:", err)
+	}
+}
+
+// A connection whose first bytes were peeked through r.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Start an agent with TLSAccept=cert, which closes plaintext connections without a word.
+func newTLSOnlyServer(t *testing.T) net.Listener {
+	certs := httptest.NewTLSServer(http.NotFoundHandler())
+	config := certs.TLS.Clone()
+	certs.Close()
+
+	return newRawServer(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		if first, err := br.Peek(1); err != nil || first[0] != 0x16 {
+			return
+		}
+
+		tls.Server(peekedConn{conn, br}, config).Handshake()
+	})
+}
+
+func TestErrTLSRequired(t *testing.T) {
+	agent := agentFor(newTLSOnlyServer(t))
+
+	_, err := agent.Query("agent.ping", time.Second)
+	if !errors.Is(err, ErrTLSRequired) || !errors.Is(err, ErrEmptyResponse) {
+		t.Fatal("Expected ErrTLSRequired wrapping ErrEmptyResponse, got:", err)
+	}
+
+	// The check is cached
+	if _, err := agent.QueryContext(context.Background(), "agent.ping"); !errors.Is(err, ErrTLSRequired) {
+		t.Fatal("Expected ErrTLSRequired, got:", err)
+	}
+
+	// Agents that reject us by Server= don't speak TLS either
+	rejecting := agentFor(newBannerServer(t, ""))
+	if _, err := rejecting.Query("agent.ping", time.Second); err != ErrEmptyResponse {
+		t.Fatal("Expected ErrEmptyResponse, got:", err)
+	}
+}
+
+func TestErrTLSRequiredWithHostname(t *testing.T) {
+	// The hostname check is the first query to see the empty response
+	for _, ln := range []net.Listener{newTLSOnlyServer(t), newBannerServer(t, "")} {
+		agent := agentFor(ln)
+		agent.ExpectedHostname = "web01"
+
+		within(t, 5*time.Second, func() {
+			if _, err := agent.Query("agent.ping", time.Second); !errors.Is(err, ErrEmptyResponse) {
+				t.Error("Expected ErrEmptyResponse, got:", err)
+			}
+			if _, err := agent.QueryContext(context.Background(), "agent.ping"); !errors.Is(err, ErrEmptyResponse) {
+				t.Error("Expected ErrEmptyResponse, got:", err)
+			}
+		})
+	}
+}
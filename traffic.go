@@ -0,0 +1,162 @@
+package zagent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TrafficOptions controls what InterfaceTraffic collects.
+type TrafficOptions struct {
+	Errors      bool // Also fetch in and out errors
+	Dropped     bool // Also fetch in and out dropped packets
+	Concurrency int  // Maximum number of queries in flight. Defaults to 4.
+}
+
+// InterfaceCounters are the traffic counters of a single network interface.
+type InterfaceCounters struct {
+	Name       string
+	InBytes    uint64
+	OutBytes   uint64
+	InErrors   uint64 // Only set with TrafficOptions.Errors
+	OutErrors  uint64
+	InDropped  uint64 // Only set with TrafficOptions.Dropped
+	OutDropped uint64
+	At         time.Time // When the last counter was received
+
+	// Set if the interface disappeared between discovery and fetching its
+	// counters, which are left zero.
+	Err error
+}
+
+/*
+	Discover the network interfaces with net.if.discovery and fetch the
+	net.if.in and net.if.out counters of each, concurrently. Results are in
+	discovery order. Interfaces the agent no longer knows about have Err set
+	rather than failing the call, any other error aborts it. Discovery is
+	reused from Agent.DiscoveryCache if set.
+*/
+func (a *Agent) InterfaceTraffic(ctx context.Context, opts TrafficOptions) ([]InterfaceCounters, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 4
+	}
+
+	res, err := a.queryDiscovery(ctx, "net.if.discovery")
+	if err != nil {
+		return nil, err
+	}
+	if err := res.notSupportedError("net.if.discovery"); err != nil {
+		return nil, err
+	}
+
+	names, err := discoveryValues(res.Data, "{#IFNAME}")
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make([]InterfaceCounters, len(names))
+	for i, name := range names {
+		counters[i].Name = name
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	sem := make(chan struct{}, opts.Concurrency)
+
+	for i := range counters {
+		wg.Add(1)
+		go func(c *InterfaceCounters) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if err := a.fetchCounters(ctx, c, opts); err != nil {
+				once.Do(func() { firstErr = err })
+				cancel()
+			}
+		}(&counters[i])
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return counters, nil
+}
+
+// Fill in c's counters, returning errors other than the interface being gone.
+func (a *Agent) fetchCounters(ctx context.Context, c *InterfaceCounters, opts TrafficOptions) error {
+	type counter struct {
+		dest *uint64
+		key  string
+	}
+
+	counters := []counter{
+		{&c.InBytes, BuildKey("net.if.in", c.Name)},
+		{&c.OutBytes, BuildKey("net.if.out", c.Name)},
+	}
+	if opts.Errors {
+		counters = append(counters,
+			counter{&c.InErrors, BuildKey("net.if.in", c.Name, "errors")},
+			counter{&c.OutErrors, BuildKey("net.if.out", c.Name, "errors")})
+	}
+	if opts.Dropped {
+		counters = append(counters,
+			counter{&c.InDropped, BuildKey("net.if.in", c.Name, "dropped")},
+			counter{&c.OutDropped, BuildKey("net.if.out", c.Name, "dropped")})
+	}
+
+	for _, counter := range counters {
+		res, err := a.QueryContext(ctx, counter.key)
+		if err != nil {
+			return err
+		}
+
+		var nsErr *NotSupportedError
+		if err := res.notSupportedError(counter.key); errors.As(err, &nsErr) {
+			*c = InterfaceCounters{Name: c.Name, Err: err}
+			return nil
+		}
+
+		if *counter.dest, err = strconv.ParseUint(res.String(), 10, 64); err != nil {
+			return err
+		}
+		c.At = res.ReceivedAt
+	}
+
+	return nil
+}
+
+/*
+	Return the value of macro from every entry of a low level discovery
+	result. Both the bare array returned since 4.2 and the older
+	{"data": [...]} form are accepted.
+*/
+func discoveryValues(data []byte, macro string) ([]string, error) {
+	var entries []map[string]interface{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		var wrapped struct {
+			Data []map[string]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(data, &wrapped); err != nil {
+			return nil, err
+		}
+		entries = wrapped.Data
+	}
+
+	values := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if value, ok := entry[macro].(string); ok {
+			values = append(values, value)
+		}
+	}
+
+	return values, nil
+}
@@ -0,0 +1,55 @@
+package zagent
+
+import (
+	"context"
+	"testing"
+)
+
+func TestInterfaceTraffic(t *testing.T) {
+	agent := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"net.if.discovery":        `[{"{#IFNAME}":"eth0"},{"{#IFNAME}":"veth1a2b"},{"{#IFNAME}":"lo"}]`,
+		"net.if.in[eth0]":         "1000",
+		"net.if.out[eth0]":        "2000",
+		"net.if.in[eth0,errors]":  "3",
+		"net.if.out[eth0,errors]": "4",
+		"net.if.in[lo]":           "50",
+		"net.if.out[lo]":          "50",
+		"net.if.in[lo,errors]":    "0",
+		"net.if.out[lo,errors]":   "0",
+	}).agent()
+
+	counters, err := agent.InterfaceTraffic(context.Background(), TrafficOptions{Errors: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(counters) != 3 {
+		t.Fatal("Expected 3 interfaces, got:", counters)
+	}
+
+	eth0 := counters[0]
+	if eth0.Name != "eth0" || eth0.InBytes != 1000 || eth0.OutBytes != 2000 || eth0.InErrors != 3 || eth0.OutErrors != 4 || eth0.At.IsZero() {
+		t.Errorf("Unexpected counters: %+v", eth0)
+	}
+
+	// veth1a2b went away after discovery
+	if counters[1].Name != "veth1a2b" || counters[1].Err == nil || counters[1].InBytes != 0 {
+		t.Errorf("Expected the vanished interface to be skipped: %+v", counters[1])
+	}
+
+	if counters[2].Name != "lo" || counters[2].InBytes != 50 || counters[2].Err != nil {
+		t.Errorf("Unexpected counters: %+v", counters[2])
+	}
+}
+
+func TestDiscoveryValues(t *testing.T) {
+	for _, data := range []string{
+		`[{"{#IFNAME}":"eth0"}]`,
+		`{"data":[{"{#IFNAME}":"eth0"}]}`,
+	} {
+		values, err := discoveryValues([]byte(data), "{#IFNAME}")
+		if err != nil || len(values) != 1 || values[0] != "eth0" {
+			t.Errorf("%s: unexpected values %v (%v)", data, values, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package zagent
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+/*
+	Parse a URL such as zabbix://host:port?timeout=5s into an Agent. The
+	port defaults to DefaultPort and the supported query parameters are:
+
+		timeout                  Agent.Timeout, e.g. 5s
+		max_data_length          Agent.MaxDataLength in bytes
+		expected_hostname        Agent.ExpectedHostname
+		hostname_check_interval  Agent.HostnameCheckInterval, e.g. 10m
+		ip                       Agent.IP
+		idle_timeout             Agent.IdleTimeout, e.g. 10s
+		min_read_rate            Agent.MinReadRate in bytes per second
+		min_read_rate_window     Agent.MinReadRateWindow, e.g. 5s
+		expect_connection_close  Agent.ExpectConnectionClose, e.g. true
+		framing                  Agent.Framing: plain, zbxd, zbxd-json or auto
+		allowed_keys             One of Agent.AllowedKeys, repeated for each
+
+	Any other parameter is an error. Labels, AllowRemoteCommands (so a URL
+	can't enable remote commands), function fields and shared caches or
+	budgets have no parameter.
+*/
+func ParseURL(rawURL string) (*Agent, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case u.Scheme != "zabbix":
+		return nil, fmt.Errorf("%s: scheme must be zabbix", rawURL)
+	case u.Hostname() == "":
+		return nil, fmt.Errorf("%s: missing host", rawURL)
+	case u.User != nil || (u.Path != "" && u.Path != "/") || u.Fragment != "":
+		return nil, fmt.Errorf("%s: only a host, port and query parameters are allowed", rawURL)
+	}
+
+	agent := NewAgent(u.Hostname())
+	if u.Port() != "" {
+		if agent.Port, err = strconv.Atoi(u.Port()); err != nil {
+			return nil, fmt.Errorf("%s: invalid port: %w", rawURL, err)
+		}
+	}
+
+	for name, values := range u.Query() {
+		value := values[len(values)-1]
+
+		switch name {
+		case "timeout":
+			agent.Timeout, err = time.ParseDuration(value)
+		case "max_data_length":
+			agent.MaxDataLength, err = strconv.ParseUint(value, 10, 64)
+		case "expected_hostname":
+			agent.ExpectedHostname = value
+		case "hostname_check_interval":
+			agent.HostnameCheckInterval, err = time.ParseDuration(value)
+		case "ip":
+			if agent.IP = net.ParseIP(value); agent.IP == nil {
+				err = fmt.Errorf("invalid IP address %q", value)
+			}
+		case "idle_timeout":
+			agent.IdleTimeout, err = time.ParseDuration(value)
+		case "min_read_rate":
+			agent.MinReadRate, err = strconv.ParseFloat(value, 64)
+		case "min_read_rate_window":
+			agent.MinReadRateWindow, err = time.ParseDuration(value)
+		case "expect_connection_close":
+			agent.ExpectConnectionClose, err = strconv.ParseBool(value)
+		case "framing":
+			agent.Framing, err = parseFramingMode(value)
+		case "allowed_keys":
+			agent.AllowedKeys = values
+		case "tls":
+			err = fmt.Errorf("TLS is not supported")
+		default:
+			err = fmt.Errorf("unknown parameter")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", rawURL, name, err)
+		}
+	}
+
+	return agent, nil
+}
+
+/*
+	Returns the agent as a zabbix:// URL that ParseURL turns back into an
+	equivalent Agent, as far as the options listed on ParseURL go.
+*/
+func (a *Agent) URL() string {
+	query := url.Values{}
+	if a.Timeout > 0 {
+		query.Set("timeout", a.Timeout.String())
+	}
+	if a.MaxDataLength > 0 {
+		query.Set("max_data_length", strconv.FormatUint(a.MaxDataLength, 10))
+	}
+	if a.ExpectedHostname != "" {
+		query.Set("expected_hostname", a.ExpectedHostname)
+	}
+	if a.HostnameCheckInterval > 0 {
+		query.Set("hostname_check_interval", a.HostnameCheckInterval.String())
+	}
+	if a.IP != nil {
+		query.Set("ip", a.IP.String())
+	}
+	if a.IdleTimeout > 0 {
+		query.Set("idle_timeout", a.IdleTimeout.String())
+	}
+	if a.MinReadRate > 0 {
+		query.Set("min_read_rate", strconv.FormatFloat(a.MinReadRate, 'g', -1, 64))
+	}
+	if a.MinReadRateWindow > 0 {
+		query.Set("min_read_rate_window", a.MinReadRateWindow.String())
+	}
+	if a.ExpectConnectionClose {
+		query.Set("expect_connection_close", "true")
+	}
+	if a.Framing != FramingPlain {
+		query.Set("framing", a.Framing.String())
+	}
+	if len(a.AllowedKeys) > 0 {
+		query["allowed_keys"] = a.AllowedKeys
+	}
+
+	u := url.URL{
+		Scheme:   "zabbix",
+		Host:     net.JoinHostPort(a.Host, strconv.Itoa(a.Port)),
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// Parse a FramingMode as returned by its String method.
+func parseFramingMode(s string) (FramingMode, error) {
+	for _, mode := range []FramingMode{FramingPlain, FramingZBXD, FramingZBXDJSON, FramingAuto} {
+		if s == mode.String() {
+			return mode, nil
+		}
+	}
+	return FramingPlain, fmt.Errorf("unknown framing %q", s)
+}
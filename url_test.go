@@ -0,0 +1,95 @@
+package zagent
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseURL(t *testing.T) {
+	agent, err := ParseURL("zabbix://web01.example.com:10051?timeout=5s&max_data_length=1024&expected_hostname=web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if agent.Host != "web01.example.com" || agent.Port != 10051 || agent.Timeout != 5*time.Second ||
+		agent.MaxDataLength != 1024 || agent.ExpectedHostname != "web01" {
+		t.Fatalf("Unexpected agent: %+v", agent)
+	}
+
+	agent, err = ParseURL("zabbix://[2001:db8::1]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if agent.Host != "2001:db8::1" || agent.Port != DefaultPort {
+		t.Fatalf("Unexpected agent: %+v", agent)
+	}
+}
+
+func TestParseURLErrors(t *testing.T) {
+	urls := []string{
+		"http://web01",
+		"zabbix://",
+		"zabbix://web01:port",
+		"zabbix://web01/path",
+		"zabbix://user@web01",
+		"zabbix://web01?timeout=soon",
+		"zabbix://web01?tls=psk",
+		"zabbix://web01?retries=3",
+		"zabbix://web01?ip=web01",
+		"zabbix://web01?framing=zbxd2",
+		"zabbix://web01?expect_connection_close=maybe",
+	}
+
+	for _, u := range urls {
+		if _, err := ParseURL(u); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
+
+func TestAgentURL(t *testing.T) {
+	urls := []string{
+		"zabbix://web01:10050",
+		"zabbix://[2001:db8::1]:10051?timeout=2.5s",
+		"zabbix://web01:10050?expected_hostname=web01&hostname_check_interval=10m0s&max_data_length=4096&timeout=5s",
+		"zabbix://web01:10050?allowed_keys=agent.%2A&allowed_keys=vfs.fs.size%5B%2A%5D&expect_connection_close=true&framing=zbxd-json" +
+			"&idle_timeout=10s&ip=192.0.2.1&min_read_rate=1024.5&min_read_rate_window=5s",
+	}
+
+	for _, u := range urls {
+		agent, err := ParseURL(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if agent.URL() != u {
+			t.Errorf("Expected %s, got %s", u, agent.URL())
+		}
+	}
+}
+
+func TestAgentURLRoundTrip(t *testing.T) {
+	agent := &Agent{
+		Host:                  "web01",
+		Port:                  10051,
+		IP:                    net.ParseIP("2001:db8::1"),
+		Timeout:               5 * time.Second,
+		IdleTimeout:           time.Second,
+		MinReadRate:           512,
+		MinReadRateWindow:     2 * time.Second,
+		ExpectConnectionClose: true,
+		Framing:               FramingAuto,
+		AllowedKeys:           []string{"agent.*", "system.cpu.util[*]"},
+	}
+
+	parsed, err := ParseURL(agent.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, agent) {
+		t.Fatalf("Expected %+v, got %+v", agent, parsed)
+	}
+}
@@ -0,0 +1,160 @@
+package zagent
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Variant is the agent implementation, as reported by agent.variant.
+type Variant int
+
+const (
+	VariantUnknown Variant = iota
+	VariantAgentd          // The classic C zabbix_agentd
+	VariantAgent2          // The Go zabbix_agent2
+)
+
+func (v Variant) String() string {
+	switch v {
+	case VariantAgentd:
+		return "agentd"
+	case VariantAgent2:
+		return "agent2"
+	}
+	return "unknown"
+}
+
+// Encodes the variant as its name, e.g. in JSON.
+func (v Variant) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
+
+/*
+	Returns whether the agent is zabbix_agentd or zabbix_agent2. agent.variant
+	is used where available. Older agents don't support it and are told apart
+	by how they reject it (agent2 reports an unknown metric) and by version,
+	agent2 didn't exist before 4.4. A known variant is cached on the Agent,
+	VariantUnknown and errors aren't.
+*/
+func (a *Agent) Variant(ctx context.Context) (Variant, error) {
+	if v := a.knownVariant(); v != VariantUnknown {
+		return v, nil
+	}
+
+	res, err := a.QueryContext(ctx, "agent.variant")
+	if err != nil {
+		return VariantUnknown, err
+	}
+
+	v := VariantUnknown
+	switch res.String() {
+	case "1":
+		v = VariantAgentd
+	case "2":
+		v = VariantAgent2
+	default:
+		var nsErr *NotSupportedError
+		if !errors.As(res.notSupportedError("agent.variant"), &nsErr) {
+			break
+		}
+		if strings.HasPrefix(nsErr.Reason, "Unknown metric") {
+			v = VariantAgent2
+			break
+		}
+
+		if res, err = a.QueryContext(ctx, "agent.version"); err != nil {
+			return VariantUnknown, err
+		}
+		if major, minor, ok := majorMinor(res.String()); ok && (major < 4 || major == 4 && minor < 4) {
+			v = VariantAgentd
+		}
+	}
+
+	a.mu.Lock()
+	a.variant = v
+	a.mu.Unlock()
+
+	return v, nil
+}
+
+// Returns the cached variant without querying the agent.
+func (a *Agent) knownVariant() Variant {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.variant
+}
+
+// Parse the major and minor numbers of an agent.version value such as 6.0.21.
+func majorMinor(version string) (major, minor int, ok bool) {
+	_, err := fmt.Sscanf(version, "%d.%d", &major, &minor)
+	return major, minor, err == nil
+}
+
+/*
+	Compare two agent versions such as 6.0.21, returning -1 if a is older
+	than b, 0 if they're the same and 1 if a is newer. Missing components
+	count as 0 so 6.0 equals 6.0.0 and is older than 6.0.21. The last
+	component may carry a pre-release suffix, e.g. 7.0.0rc1, which is
+	older than the release itself; suffixes are compared as text.
+*/
+func CompareVersions(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < max(len(va.parts), len(vb.parts)); i++ {
+		pa, pb := 0, 0
+		if i < len(va.parts) {
+			pa = va.parts[i]
+		}
+		if i < len(vb.parts) {
+			pb = vb.parts[i]
+		}
+		if pa != pb {
+			return cmp.Compare(pa, pb), nil
+		}
+	}
+
+	switch {
+	case va.suffix == vb.suffix:
+		return 0, nil
+	case va.suffix == "":
+		return 1, nil
+	case vb.suffix == "":
+		return -1, nil
+	}
+	return strings.Compare(va.suffix, vb.suffix), nil
+}
+
+type version struct {
+	parts  []int
+	suffix string // Pre-release suffix of the last part, e.g. rc1
+}
+
+func parseVersion(s string) (version, error) {
+	var v version
+	fields := strings.Split(strings.TrimSpace(s), ".")
+	for i, field := range fields {
+		digits := len(field) - len(strings.TrimLeft(field, "0123456789"))
+		if digits == 0 || digits < len(field) && i < len(fields)-1 {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+
+		n, err := strconv.Atoi(field[:digits])
+		if err != nil {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		v.parts = append(v.parts, n)
+		v.suffix = field[digits:]
+	}
+	return v, nil
+}
@@ -0,0 +1,117 @@
+package zagent
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestVariant(t *testing.T) {
+	tests := []struct {
+		name  string
+		items map[string]string
+		want  Variant
+	}{
+		{"agentd", map[string]string{"agent.variant": "1"}, VariantAgentd},
+		{"agent2", map[string]string{"agent.variant": "2"}, VariantAgent2},
+		{"old agent2", map[string]string{"agent.variant": NotSupported + "\x00Unknown metric agent.variant"}, VariantAgent2},
+		{"old agentd", map[string]string{"agent.version": "4.0.44"}, VariantAgentd},
+		{"unknown", map[string]string{"agent.version": "5.0.1"}, VariantUnknown},
+	}
+
+	for _, test := range tests {
+		fake := newFakeAgent(t, "tcp", "127.0.0.1:0", test.items)
+		agent := fake.agent()
+
+		v, err := agent.Variant(context.Background())
+		if err != nil || v != test.want {
+			t.Errorf("%s: expected %v, got %v (%v)", test.name, test.want, v, err)
+		}
+
+		// Known variants are cached
+		n := len(fake.received())
+		agent.Variant(context.Background())
+		if cached := len(fake.received()) == n; cached != (test.want != VariantUnknown) {
+			t.Errorf("%s: expected caching only for known variants", test.name)
+		}
+	}
+}
+
+func TestVariantJSON(t *testing.T) {
+	b, err := json.Marshal(ScanResult{Variant: VariantAgent2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]interface{}
+	json.Unmarshal(b, &decoded)
+	if decoded["Variant"] != "agent2" {
+		t.Fatal("Unexpected JSON:", string(b))
+	}
+}
+
+func TestSessionAgentd(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{
+		"agent.variant": "1",
+		"agent.ping":    "1",
+	})
+	agent := fake.agent()
+
+	if _, err := agent.Variant(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := agent.Dial(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Every key after the first needs a new connection
+	for i := 0; i < 3; i++ {
+		if _, err := s.Query("agent.ping", time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if keys := fake.received(); len(keys) != 4 {
+		t.Fatal("Expected each key to be sent once, got:", keys)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"6.0.21", "6.0.21", 0},
+		{"6.0", "6.0.0", 0},
+		{"6.0", "6.0.21", -1},
+		{"6.0.21", "6.0", 1},
+		{"5.4.9", "6.0.0", -1},
+		{"6.0.9", "6.0.10", -1},
+		{"7.0.0", "6.4.15", 1},
+		{"7.0.0rc1", "7.0.0", -1},
+		{"7.0.0rc2", "7.0.0rc1", 1},
+		{"7.0.0beta1", "7.0.0rc1", -1},
+		{" 6.0.21\n", "6.0.21", 0},
+	}
+
+	for _, test := range tests {
+		got, err := CompareVersions(test.a, test.b)
+		if err != nil {
+			t.Errorf("%q vs %q: %v", test.a, test.b, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q vs %q: expected %d, got %d", test.a, test.b, test.want, got)
+		}
+	}
+
+	for _, invalid := range []string{"", "six", "6..0", "6.x.1", "v6.0", "6.0."} {
+		if _, err := CompareVersions(invalid, "6.0"); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package zagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// WatchEvent is the result of one query made by Agent.Watch.
+type WatchEvent struct {
+	Response *Response
+	Err      error
+	At       time.Time // When the query started
+}
+
+/*
+	Query the key straight away and then every interval, sending each
+	result on the returned channel until ctx is done, when the channel is
+	closed. Errors are sent as events and watching continues, except for
+	ErrKeyNotAllowed which can't go away and closes the channel after its
+	event. An interval < 1 sends an error event without querying and
+	closes the channel. If a query takes longer than
+	interval the missed queries are skipped. Events must be received
+	promptly, the next query isn't made until the last event is.
+*/
+func (a *Agent) Watch(ctx context.Context, key string, interval time.Duration) <-chan WatchEvent {
+	events := make(chan WatchEvent)
+	if interval < 1 {
+		go func() {
+			defer close(events)
+			select {
+			case events <- WatchEvent{Err: fmt.Errorf("invalid watch interval %v", interval), At: time.Now()}:
+			case <-ctx.Done():
+			}
+		}()
+		return events
+	}
+
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer close(events)
+		defer ticker.Stop()
+
+		for {
+			event := WatchEvent{At: time.Now()}
+			event.Response, event.Err = a.QueryContext(ctx, key)
+			if ctx.Err() != nil {
+				return
+			}
+
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+
+			if errors.Is(event.Err, ErrKeyNotAllowed) {
+				return
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events
+}
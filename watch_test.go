@@ -0,0 +1,94 @@
+package zagent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	var n int32
+	agent := newFakeAgentFunc(t, "tcp", "127.0.0.1:0", func(key string) string {
+		return strconv.Itoa(int(atomic.AddInt32(&n, 1)))
+	}).agent()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := agent.Watch(ctx, "system.uptime", 50*time.Millisecond)
+
+	var last time.Time
+	for i := 1; i <= 3; i++ {
+		event := <-events
+		if event.Err != nil {
+			t.Fatal(event.Err)
+		}
+		if event.Response.String() != strconv.Itoa(i) {
+			t.Fatalf("Event %d: unexpected value %s", i, event.Response.String())
+		}
+		if i > 1 && event.At.Sub(last) < 40*time.Millisecond {
+			t.Fatal("Events should be an interval apart, got", event.At.Sub(last))
+		}
+		last = event.At
+	}
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			// At most one event can be in flight when cancelling
+			if _, ok := <-events; ok {
+				t.Fatal("Expected the channel to be closed")
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The channel wasn't closed after cancelling")
+	}
+}
+
+func TestWatchErrors(t *testing.T) {
+	// Errors don't stop watching
+	agent := agentFor(newRawServer(t, func(conn net.Conn) {}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := agent.Watch(ctx, "agent.ping", 10*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if event := <-events; !errors.Is(event.Err, ErrEmptyResponse) {
+			t.Fatal("Expected ErrEmptyResponse, got:", event.Err)
+		}
+	}
+	cancel()
+
+	// But a key that can never be sent does
+	agent.AllowedKeys = []string{"agent.*"}
+	events = agent.Watch(context.Background(), "system.run[reboot]", 10*time.Millisecond)
+	if event := <-events; !errors.Is(event.Err, ErrKeyNotAllowed) {
+		t.Fatal("Expected ErrKeyNotAllowed, got:", event.Err)
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("Expected the channel to be closed")
+	}
+}
+
+func TestWatchInvalidInterval(t *testing.T) {
+	fake := newFakeAgent(t, "tcp", "127.0.0.1:0", map[string]string{"agent.ping": "1"})
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		events := fake.agent().Watch(context.Background(), "agent.ping", interval)
+		if event := <-events; event.Err == nil || event.Response != nil {
+			t.Fatalf("%v: expected an error, got: %+v", interval, event)
+		}
+		if _, ok := <-events; ok {
+			t.Fatalf("%v: expected the channel to be closed", interval)
+		}
+	}
+
+	if keys := fake.received(); len(keys) != 0 {
+		t.Fatal("Expected no queries, got:", keys)
+	}
+}